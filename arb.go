@@ -0,0 +1,278 @@
+/*
+ * MIT License
+ *
+ * Copyright (c) 2018 Igor Konovalov
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+package main
+
+import (
+	"context"
+	"sort"
+	wr "github.com/ikonovalov/global-trade/wrappers"
+	"github.com/shopspring/decimal"
+)
+
+type (
+	// arbVenue is an exchange with its listed markets and available funds.
+	// Available is nil when balances are unknown, the amount is not limited by funds then.
+	arbVenue struct {
+		Exchange  wr.Exchange
+		Markets   map[string]wr.Market
+		Available map[string]decimal.Decimal
+		Tickers   map[string]wr.Ticker
+	}
+
+	// arbOpportunity is buying Pair at the ask of one exchange and selling at the bid of another.
+	// NetSpread is in percents of the buy cost including taker fees, Profit is in quote currency.
+	arbOpportunity struct {
+		Pair       wr.Pair
+		Buy        *arbVenue
+		Sell       *arbVenue
+		BuyPrice   decimal.Decimal
+		SellPrice  decimal.Decimal
+		NetSpread  decimal.Decimal
+		TopAmount  decimal.Decimal
+		Executable decimal.Decimal
+		Profit     decimal.Decimal
+	}
+)
+
+// feeRate converts the fee in percents into the multiplier part: 0.2 -> 0.002
+func feeRate(fee decimal.Decimal) decimal.Decimal {
+	return fee.Div(hundred)
+}
+
+// netSpread is the percent gained buying at ask with buyFee and selling at bid with sellFee
+func netSpread(ask, buyFee, bid, sellFee decimal.Decimal) decimal.Decimal {
+	cost := ask.Mul(decimal.New(1, 0).Add(feeRate(buyFee)))
+	if cost.Sign() <= 0 {
+		return decimal.Zero
+	}
+	proceeds := bid.Mul(decimal.New(1, 0).Sub(feeRate(sellFee)))
+	return proceeds.Sub(cost).Div(cost).Mul(hundred)
+}
+
+func (o *arbOpportunity) buyFee() decimal.Decimal {
+	return o.Buy.Markets[o.Pair.String()].Fee
+}
+
+func (o *arbOpportunity) sellFee() decimal.Decimal {
+	return o.Sell.Markets[o.Pair.String()].Fee
+}
+
+// quote evaluates the opportunity at the best ask and bid and their quantities
+func (o *arbOpportunity) quote(ask, askQuantity, bid, bidQuantity decimal.Decimal) {
+	o.BuyPrice, o.SellPrice = ask, bid
+	o.NetSpread = netSpread(ask, o.buyFee(), bid, o.sellFee())
+	o.TopAmount = decimal.Min(askQuantity, bidQuantity)
+
+	buyCost := ask.Mul(decimal.New(1, 0).Add(feeRate(o.buyFee())))
+	o.Executable = o.TopAmount
+	if o.Buy.Available != nil && buyCost.Sign() > 0 {
+		o.Executable = decimal.Min(o.Executable, o.Buy.Available[o.Pair.Quote].Div(buyCost))
+	}
+	if o.Sell.Available != nil {
+		o.Executable = decimal.Min(o.Executable, o.Sell.Available[o.Pair.Base])
+	}
+	unitGain := bid.Mul(decimal.New(1, 0).Sub(feeRate(o.sellFee()))).Sub(buyCost)
+	o.Profit = o.Executable.Mul(unitGain)
+}
+
+// loadArbVenues fetches markets and balances of every exchange. Exchange without markets is dropped,
+// failed balances leave the venue with unknown funds.
+func loadArbVenues(ctx context.Context, exchanges []wr.Exchange) ([]*arbVenue, []error) {
+	type venueResponse struct {
+		venue *arbVenue
+		errs  []error
+	}
+	venuesChannel := make(chan venueResponse, len(exchanges))
+	for _, exc := range exchanges {
+		go func(exc wr.Exchange) {
+			marketsChannel := make(chan wr.MarketsResponse, 1)
+			balanceChannel := make(chan wr.BalanceResponse, 1)
+			go exc.Markets(ctx, marketsChannel)
+			go exc.GetBalances(ctx, balanceChannel)
+			markets, balance := <-marketsChannel, <-balanceChannel
+
+			var rs venueResponse
+			if balance.Err != nil {
+				rs.errs = append(rs.errs, balance.Err)
+			}
+			if markets.Err != nil {
+				rs.errs = append(rs.errs, markets.Err)
+				venuesChannel <- rs
+				return
+			}
+			rs.venue = &arbVenue{Exchange: exc, Markets: make(map[string]wr.Market)}
+			for _, m := range markets.Markets {
+				if !m.Hidden {
+					rs.venue.Markets[m.Pair.String()] = m
+				}
+			}
+			if balance.Err == nil {
+				rs.venue.Available = balance.Balance.AvailableFunds
+			}
+			venuesChannel <- rs
+		}(exc)
+	}
+
+	venues := make([]*arbVenue, 0, len(exchanges))
+	var errs []error
+	for range exchanges {
+		rs := <-venuesChannel
+		errs = append(errs, rs.errs...)
+		if rs.venue != nil {
+			venues = append(venues, rs.venue)
+		}
+	}
+	sort.Slice(venues, func(i, j int) bool { return venues[i].Exchange.Name < venues[j].Exchange.Name })
+	return venues, errs
+}
+
+// commonPairs returns pairs listed on two exchanges at least, restricted to filter when it is not empty
+func commonPairs(venues []*arbVenue, filter []string) []string {
+	allowed := make(map[string]bool, len(filter))
+	for _, p := range filter {
+		allowed[p] = true
+	}
+	listings := make(map[string]int)
+	for _, v := range venues {
+		for pair := range v.Markets {
+			if len(allowed) == 0 || allowed[pair] {
+				listings[pair]++
+			}
+		}
+	}
+	rs := make([]string, 0)
+	for pair, n := range listings {
+		if n > 1 {
+			rs = append(rs, pair)
+		}
+	}
+	sort.Strings(rs)
+	return rs
+}
+
+// loadArbTickers fills tickers of the pairs listed on the venue
+func loadArbTickers(ctx context.Context, venues []*arbVenue, pairs []string) []error {
+	errsChannel := make(chan error, len(venues))
+	for _, v := range venues {
+		listed := make([]string, 0, len(pairs))
+		for _, pair := range pairs {
+			if _, ok := v.Markets[pair]; ok {
+				listed = append(listed, pair)
+			}
+		}
+		go func(v *arbVenue, listed []string) {
+			channel := make(chan wr.TickersResponse, 1)
+			go v.Exchange.GetTickers(ctx, listed, channel)
+			rs := <-channel
+			v.Tickers = rs.Tickers
+			errsChannel <- rs.Err
+		}(v, listed)
+	}
+	var errs []error
+	for range venues {
+		if err := <-errsChannel; err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errs
+}
+
+// verifyTopOfBook re-quotes the opportunity at the best levels of both order books.
+// Tickers of some exchanges are cached for a while so they are used for screening only.
+func verifyTopOfBook(ctx context.Context, o *arbOpportunity) error {
+	buyChannel := make(chan wr.OrderBookResponse, 1)
+	sellChannel := make(chan wr.OrderBookResponse, 1)
+	go o.Buy.Exchange.OrderBook(ctx, o.Pair.String(), 1, buyChannel)
+	go o.Sell.Exchange.OrderBook(ctx, o.Pair.String(), 1, sellChannel)
+	buyBook, sellBook := <-buyChannel, <-sellChannel
+	if buyBook.Err != nil {
+		return buyBook.Err
+	}
+	if sellBook.Err != nil {
+		return sellBook.Err
+	}
+	if len(buyBook.OrderBook.Asks) == 0 || len(sellBook.OrderBook.Bids) == 0 {
+		o.quote(decimal.Zero, decimal.Zero, decimal.Zero, decimal.Zero)
+		return nil
+	}
+	ask, bid := buyBook.OrderBook.Asks[0], sellBook.OrderBook.Bids[0]
+	o.quote(ask.Price, ask.Quantity, bid.Price, bid.Quantity)
+	return nil
+}
+
+// scanArbitrage screens common pairs of the exchanges by ticker prices, verifies top candidates
+// against order books and returns opportunities with the net spread above minSpread, best first.
+func scanArbitrage(ctx context.Context, exchanges []wr.Exchange, filter []string, top int, minSpread decimal.Decimal) ([]*arbOpportunity, []error) {
+	venues, errs := loadArbVenues(ctx, exchanges)
+	pairs := commonPairs(venues, filter)
+	if len(pairs) == 0 {
+		return nil, errs
+	}
+	errs = append(errs, loadArbTickers(ctx, venues, pairs)...)
+
+	candidates := make([]*arbOpportunity, 0)
+	for _, pairName := range pairs {
+		pair, _ := wr.ParsePair(pairName)
+		for _, buy := range venues {
+			for _, sell := range venues {
+				buyTicker, buyOk := buy.Tickers[pairName]
+				sellTicker, sellOk := sell.Tickers[pairName]
+				if buy == sell || !buyOk || !sellOk || buyTicker.Sell.Sign() <= 0 || sellTicker.Buy.Sign() <= 0 {
+					continue
+				}
+				o := &arbOpportunity{Pair: pair, Buy: buy, Sell: sell}
+				o.quote(buyTicker.Sell, decimal.Zero, sellTicker.Buy, decimal.Zero)
+				if o.NetSpread.GreaterThan(minSpread) {
+					candidates = append(candidates, o)
+				}
+			}
+		}
+	}
+	sort.SliceStable(candidates, func(i, j int) bool { return candidates[i].NetSpread.GreaterThan(candidates[j].NetSpread) })
+	if top > 0 && len(candidates) > top {
+		candidates = candidates[:top]
+	}
+
+	errsChannel := make(chan error, len(candidates))
+	for _, o := range candidates {
+		go func(o *arbOpportunity) {
+			errsChannel <- verifyTopOfBook(ctx, o)
+		}(o)
+	}
+	for range candidates {
+		if err := <-errsChannel; err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	rs := make([]*arbOpportunity, 0, len(candidates))
+	for _, o := range candidates {
+		if o.TopAmount.Sign() > 0 && o.NetSpread.GreaterThan(minSpread) {
+			rs = append(rs, o)
+		}
+	}
+	sort.SliceStable(rs, func(i, j int) bool { return rs[i].NetSpread.GreaterThan(rs[j].NetSpread) })
+	return rs, errs
+}
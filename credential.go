@@ -25,11 +25,44 @@
 package main
 
 import (
-	"io/ioutil"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
 	"os"
-	"github.com/ikonovalov/go-yobit"
+	"path/filepath"
+	"regexp"
+	"strings"
 	"github.com/ikonovalov/global-trade/wrappers"
+	"golang.org/x/crypto/scrypt"
+	"golang.org/x/crypto/ssh/terminal"
+)
+
+const (
+	// credentialsVersion is the current GlobalCredentials schema version
+	credentialsVersion uint16 = 2
+
+	passphraseEnv = "GTR_PASSPHRASE"
+	credentialKdf = "scrypt"
+
+	// scrypt parameters recommended for interactive logins
+	scryptN      = 32768
+	scryptR      = 8
+	scryptP      = 1
+	scryptKeyLen = 32
+	saltLen      = 16
+)
+
+var (
+	errCredentialLocked   = errors.New("credential file is already encrypted")
+	errCredentialUnlocked = errors.New("credential file is not encrypted")
+	errPassphraseMismatch = errors.New("passphrases do not match")
+	errEmptyPassphrase    = errors.New("empty passphrase")
+
+	ethereumAccountPattern = regexp.MustCompile("^0x[0-9a-fA-F]{40}$")
 )
 
 type GlobalCredentials struct {
@@ -41,26 +74,500 @@ type GlobalCredentials struct {
 	BlockCypher wrappers.BlockCypherCredential `json:"blockcypher,omitempty"`
 }
 
+// encryptedCredentials is the at-rest form of GlobalCredentials when Encryption is set.
+// Data holds AES-256-GCM sealed JSON of GlobalCredentials, the key is derived from
+// the passphrase with scrypt.
+type encryptedCredentials struct {
+	Version    uint16 `json:"version"`
+	Encryption bool   `json:"encryption"`
+	Kdf        string `json:"kdf"`
+	Salt       []byte `json:"salt"`
+	Nonce      []byte `json:"nonce"`
+	Data       []byte `json:"data"`
+}
+
+// legacyCredentials is the layout written by init before schema version 1: bare Yobit key and secret.
+type legacyCredentials struct {
+	Key    string `json:"key"`
+	Secret string `json:"secret"`
+}
+
 func loadApiCredential() (GlobalCredentials, error) {
+	keys, _, err := loadApiCredentialWithPassphrase()
+	return keys, err
+}
+
+// loadApiCredentialWithPassphrase returns credentials and the passphrase used to
+// unlock them. The passphrase is nil for plaintext credential file.
+func loadApiCredentialWithPassphrase() (GlobalCredentials, []byte, error) {
 	file, e := ioutil.ReadFile(credentialFile)
 	if e != nil {
-		return GlobalCredentials{}, e
+		return GlobalCredentials{}, nil, e
+	}
+	var envelope encryptedCredentials
+	if err := json.Unmarshal(file, &envelope); err != nil {
+		return GlobalCredentials{}, nil, err
+	}
+	if !envelope.Encryption {
+		var keys GlobalCredentials
+		if err := json.Unmarshal(file, &keys); err != nil {
+			return GlobalCredentials{}, nil, err
+		}
+		if keys.Version == 0 {
+			var legacy legacyCredentials
+			json.Unmarshal(file, &legacy)
+			if keys.Yobit.Key == "" && legacy.Key != "" {
+				keys.Yobit = wrappers.YobitApiCredential{Key: legacy.Key, Secret: legacy.Secret}
+			}
+		}
+		return migrateCredentials(keys), nil, checkCredentialsVersion(keys)
+	}
+
+	passphrase, err := readPassphrase("Passphrase: ")
+	if err != nil {
+		return GlobalCredentials{}, nil, err
+	}
+	keys, err := decryptCredentials(envelope, passphrase)
+	if err != nil {
+		return GlobalCredentials{}, nil, err
+	}
+	return migrateCredentials(keys), passphrase, checkCredentialsVersion(keys)
+}
+
+// migrateCredentials moves the version 1 LiteCoin address list into the per-coin BlockCypher addresses.
+func migrateCredentials(keys GlobalCredentials) GlobalCredentials {
+	if len(keys.BlockCypher.LTC) == 0 {
+		return keys
+	}
+	addresses := make(map[string][]string, len(keys.BlockCypher.Addresses)+1)
+	for coin, list := range keys.BlockCypher.Addresses {
+		addresses[coin] = list
+	}
+	addresses["ltc"] = append(addresses["ltc"], keys.BlockCypher.LTC...)
+	keys.BlockCypher.Addresses = addresses
+	keys.BlockCypher.LTC = nil
+	return keys
+}
+
+func checkCredentialsVersion(keys GlobalCredentials) error {
+	if keys.Version > credentialsVersion {
+		return fmt.Errorf("credential file version %d is newer than supported %d", keys.Version, credentialsVersion)
+	}
+	return nil
+}
+
+// validate checks credentials against the current schema version.
+func (keys GlobalCredentials) validate() error {
+	if err := checkCredentialsVersion(keys); err != nil {
+		return err
+	}
+	if (keys.Yobit.Key == "") != (keys.Yobit.Secret == "") {
+		return errors.New("yobit: both key and secret are required")
+	}
+	if (keys.Bittrex.Key == "") != (keys.Bittrex.Secret == "") {
+		return errors.New("bittrex: both key and secret are required")
+	}
+	accounts := make(map[string]bool)
+	for _, account := range keys.Etherscan.Accounts {
+		if !ethereumAccountPattern.MatchString(account) {
+			return fmt.Errorf("etherscan: malformed account %s", account)
+		}
+		if accounts[strings.ToLower(account)] {
+			return fmt.Errorf("etherscan: duplicated account %s", account)
+		}
+		accounts[strings.ToLower(account)] = true
+	}
+	seen := make(map[string]bool)
+	for _, token := range keys.Etherscan.Tokens {
+		if !ethereumAccountPattern.MatchString(token.Contract) {
+			return fmt.Errorf("etherscan: malformed token contract %s", token.Contract)
+		}
+		if strings.TrimSpace(token.Symbol) == "" {
+			return fmt.Errorf("etherscan: empty symbol of token %s", token.Contract)
+		}
+		if token.Decimals < 0 || token.Decimals > 255 {
+			return fmt.Errorf("etherscan: token %s decimals out of range", token.Symbol)
+		}
+		if seen[strings.ToLower(token.Contract)] || seen[strings.ToUpper(token.Symbol)] {
+			return fmt.Errorf("etherscan: duplicated token %s", token.Symbol)
+		}
+		seen[strings.ToLower(token.Contract)] = true
+		seen[strings.ToUpper(token.Symbol)] = true
+	}
+	for account := range keys.Etherscan.Labels {
+		if account != strings.ToLower(account) || !accounts[account] {
+			return fmt.Errorf("etherscan: label of unknown account %s", account)
+		}
+	}
+	watched := make(map[string]bool)
+	for coin, addresses := range keys.BlockCypher.Addresses {
+		if !wrappers.IsBlockCypherCoin(coin) || coin != strings.ToLower(coin) {
+			return fmt.Errorf("blockcypher: unsupported coin %s", coin)
+		}
+		seen = make(map[string]bool)
+		for _, address := range addresses {
+			if strings.TrimSpace(address) == "" {
+				return fmt.Errorf("blockcypher: empty %s address", coin)
+			}
+			if seen[address] {
+				return fmt.Errorf("blockcypher: duplicated %s address %s", coin, address)
+			}
+			seen[address] = true
+			watched[address] = true
+		}
+	}
+	for address := range keys.BlockCypher.Labels {
+		if !watched[address] {
+			return fmt.Errorf("blockcypher: label of unknown address %s", address)
+		}
+	}
+	return nil
+}
+
+// updateCredentials loads the whole credential container, applies update and writes it back
+// keeping the encryption and the other providers sections untouched.
+func updateCredentials(update func(keys *GlobalCredentials) error) error {
+	keys, passphrase, err := loadApiCredentialWithPassphrase()
+	if os.IsNotExist(err) {
+		keys, err = GlobalCredentials{Version: credentialsVersion}, nil
+	}
+	if err != nil {
+		return err
+	}
+	if err := update(&keys); err != nil {
+		return err
+	}
+	keys.Version = credentialsVersion
+	if err := keys.validate(); err != nil {
+		return err
+	}
+	return saveApiCredential(keys, passphrase)
+}
+
+func setYobitCredential(key string, secret string) error {
+	return updateCredentials(func(keys *GlobalCredentials) error {
+		keys.Yobit = wrappers.YobitApiCredential{Key: key, Secret: secret}
+		return nil
+	})
+}
+
+func setBittrexCredential(key string, secret string) error {
+	return updateCredentials(func(keys *GlobalCredentials) error {
+		keys.Bittrex = wrappers.BittrexApiCredential{Key: key, Secret: secret}
+		return nil
+	})
+}
+
+func addEtherscanAccount(account string) error {
+	return updateCredentials(func(keys *GlobalCredentials) error {
+		keys.Etherscan.Accounts = append(keys.Etherscan.Accounts, account)
+		return nil
+	})
+}
+
+func setEtherscanApiKey(apiKey string) error {
+	return updateCredentials(func(keys *GlobalCredentials) error {
+		keys.Etherscan.ApiKey = apiKey
+		return nil
+	})
+}
+
+func addEtherscanToken(contract string, symbol string, decimals int32) error {
+	return updateCredentials(func(keys *GlobalCredentials) error {
+		token := wrappers.EthereumToken{Contract: contract, Symbol: strings.ToUpper(symbol), Decimals: decimals}
+		keys.Etherscan.Tokens = append(keys.Etherscan.Tokens, token)
+		return nil
+	})
+}
+
+func addBlockCypherAddress(coin string, address string) error {
+	return updateCredentials(func(keys *GlobalCredentials) error {
+		coin = strings.ToLower(coin)
+		if keys.BlockCypher.Addresses == nil {
+			keys.BlockCypher.Addresses = make(map[string][]string)
+		}
+		keys.BlockCypher.Addresses[coin] = append(keys.BlockCypher.Addresses[coin], address)
+		return nil
+	})
+}
+
+// labelAddress assigns label to the watched Etherscan account or BlockCypher address, empty label removes it.
+func labelAddress(address string, label string) error {
+	return updateCredentials(func(keys *GlobalCredentials) error {
+		for _, account := range keys.Etherscan.Accounts {
+			if strings.EqualFold(account, address) {
+				keys.Etherscan.Labels = setLabel(keys.Etherscan.Labels, strings.ToLower(account), label)
+				return nil
+			}
+		}
+		for _, addresses := range keys.BlockCypher.Addresses {
+			for _, a := range addresses {
+				if a == address {
+					keys.BlockCypher.Labels = setLabel(keys.BlockCypher.Labels, address, label)
+					return nil
+				}
+			}
+		}
+		return fmt.Errorf("address %s is not watched", address)
+	})
+}
+
+func setLabel(labels map[string]string, address string, label string) map[string]string {
+	label = strings.TrimSpace(label)
+	if label == "" {
+		delete(labels, address)
+		return labels
+	}
+	if labels == nil {
+		labels = make(map[string]string)
+	}
+	labels[address] = label
+	return labels
+}
+
+// removeCredential drops the whole provider section or, when entry is set, a single
+// Etherscan account, Etherscan token (contract or symbol) or BlockCypher address.
+func removeCredential(provider string, entry string) error {
+	return updateCredentials(func(keys *GlobalCredentials) error {
+		switch provider {
+		case "yobit":
+			keys.Yobit = wrappers.YobitApiCredential{}
+		case "bittrex":
+			keys.Bittrex = wrappers.BittrexApiCredential{}
+		case "etherscan":
+			if entry == "" {
+				keys.Etherscan = wrappers.EtherScanCredential{}
+				return nil
+			}
+			if accounts, removed := removeEntry(keys.Etherscan.Accounts, entry, strings.EqualFold); removed {
+				keys.Etherscan.Accounts = accounts
+				delete(keys.Etherscan.Labels, strings.ToLower(entry))
+				return nil
+			}
+			for i, token := range keys.Etherscan.Tokens {
+				if strings.EqualFold(token.Contract, entry) || strings.EqualFold(token.Symbol, entry) {
+					keys.Etherscan.Tokens = append(keys.Etherscan.Tokens[:i], keys.Etherscan.Tokens[i+1:]...)
+					return nil
+				}
+			}
+			return fmt.Errorf("etherscan: account or token %s not found", entry)
+		case "blockcypher":
+			if entry == "" {
+				keys.BlockCypher = wrappers.BlockCypherCredential{}
+				return nil
+			}
+			for coin, list := range keys.BlockCypher.Addresses {
+				addresses, removed := removeEntry(list, entry, func(a, b string) bool { return a == b })
+				if !removed {
+					continue
+				}
+				if len(addresses) == 0 {
+					delete(keys.BlockCypher.Addresses, coin)
+				} else {
+					keys.BlockCypher.Addresses[coin] = addresses
+				}
+				delete(keys.BlockCypher.Labels, entry)
+				return nil
+			}
+			return fmt.Errorf("blockcypher: address %s not found", entry)
+		default:
+			return fmt.Errorf("unknown provider %s", provider)
+		}
+		return nil
+	})
+}
+
+func removeEntry(entries []string, entry string, equal func(string, string) bool) ([]string, bool) {
+	rs := make([]string, 0, len(entries))
+	removed := false
+	for _, e := range entries {
+		if equal(e, entry) {
+			removed = true
+			continue
+		}
+		rs = append(rs, e)
+	}
+	return rs, removed
+}
+
+// saveApiCredential atomically writes credentials readable by the owner only. Credentials
+// are encrypted with passphrase when keys.Encryption is set.
+func saveApiCredential(keys GlobalCredentials, passphrase []byte) error {
+	data, err := json.MarshalIndent(keys, "", "  ")
+	if err != nil {
+		return err
+	}
+	if keys.Encryption {
+		envelope, err := encryptCredentials(data, keys.Version, passphrase)
+		if err != nil {
+			return err
+		}
+		if data, err = json.MarshalIndent(envelope, "", "  "); err != nil {
+			return err
+		}
+	}
+	if err := os.MkdirAll(filepath.Dir(credentialFile), 0700); err != nil {
+		return err
+	}
+	// the temporary file is created with 0600 mode and replaces the old one only when completely written
+	file, err := ioutil.TempFile(filepath.Dir(credentialFile), filepath.Base(credentialFile)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(file.Name())
+	if _, err := file.Write(data); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	return os.Rename(file.Name(), credentialFile)
+}
+
+func encryptCredentials(plaintext []byte, version uint16, passphrase []byte) (encryptedCredentials, error) {
+	salt := make([]byte, saltLen)
+	if _, err := rand.Read(salt); err != nil {
+		return encryptedCredentials{}, err
+	}
+	aead, err := newCredentialCipher(passphrase, salt)
+	if err != nil {
+		return encryptedCredentials{}, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return encryptedCredentials{}, err
+	}
+	return encryptedCredentials{
+		Version:    version,
+		Encryption: true,
+		Kdf:        credentialKdf,
+		Salt:       salt,
+		Nonce:      nonce,
+		Data:       aead.Seal(nil, nonce, plaintext, nil),
+	}, nil
+}
+
+func decryptCredentials(envelope encryptedCredentials, passphrase []byte) (GlobalCredentials, error) {
+	if envelope.Kdf != credentialKdf {
+		return GlobalCredentials{}, fmt.Errorf("unsupported key derivation function %q", envelope.Kdf)
+	}
+	aead, err := newCredentialCipher(passphrase, envelope.Salt)
+	if err != nil {
+		return GlobalCredentials{}, err
+	}
+	if len(envelope.Nonce) != aead.NonceSize() {
+		return GlobalCredentials{}, errors.New("malformed credential file")
+	}
+	plaintext, err := aead.Open(nil, envelope.Nonce, envelope.Data, nil)
+	if err != nil {
+		return GlobalCredentials{}, errors.New("wrong passphrase or corrupted credential file")
 	}
 	var keys GlobalCredentials
-	unmarshalError := json.Unmarshal(file, &keys)
+	err = json.Unmarshal(plaintext, &keys)
+	return keys, err
+}
 
-	return keys, unmarshalError
+func newCredentialCipher(passphrase []byte, salt []byte) (cipher.AEAD, error) {
+	key, err := scrypt.Key(passphrase, salt, scryptN, scryptR, scryptP, scryptKeyLen)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
 }
 
-func createCredentialFile(adiCredential yobit.ApiCredential) {
-	if _, err := os.Stat(credentialFile); os.IsNotExist(err) {
-		if _, err = os.Create(credentialFile); err != nil {
-			panic(err)
+// readPassphrase takes passphrase from GTR_PASSPHRASE environment variable or asks for it on the terminal.
+func readPassphrase(prompt string) ([]byte, error) {
+	if env, ok := os.LookupEnv(passphraseEnv); ok {
+		if env == "" {
+			return nil, errEmptyPassphrase
 		}
+		return []byte(env), nil
+	}
+	return promptPassphrase(prompt)
+}
+
+func promptPassphrase(prompt string) ([]byte, error) {
+	fd := int(os.Stdin.Fd())
+	if !terminal.IsTerminal(fd) {
+		return nil, fmt.Errorf("credential file is encrypted, set %s or run in a terminal", passphraseEnv)
+	}
+	fmt.Fprint(os.Stderr, prompt)
+	passphrase, err := terminal.ReadPassword(fd)
+	fmt.Fprintln(os.Stderr)
+	if err != nil {
+		return nil, err
+	}
+	if len(passphrase) == 0 {
+		return nil, errEmptyPassphrase
+	}
+	return passphrase, nil
+}
+
+// readNewPassphrase asks for a new passphrase twice. GTR_PASSPHRASE is not used here on purpose,
+// it holds the current passphrase.
+func readNewPassphrase() ([]byte, error) {
+	passphrase, err := promptPassphrase("New passphrase: ")
+	if err != nil {
+		return nil, err
+	}
+	confirmation, err := promptPassphrase("Repeat passphrase: ")
+	if err != nil {
+		return nil, err
+	}
+	if string(passphrase) != string(confirmation) {
+		return nil, errPassphraseMismatch
+	}
+	return passphrase, nil
+}
+
+func lockCredentials() error {
+	keys, _, err := loadApiCredentialWithPassphrase()
+	if err != nil {
+		return err
+	}
+	if keys.Encryption {
+		return errCredentialLocked
 	}
-	data, _ := json.Marshal(adiCredential)
-	if err := ioutil.WriteFile(credentialFile, data, 0644); err != nil {
-		panic(err)
+	passphrase, err := readNewPassphrase()
+	if err != nil {
+		return err
 	}
+	keys.Encryption = true
+	return saveApiCredential(keys, passphrase)
+}
+
+func unlockCredentials() error {
+	keys, passphrase, err := loadApiCredentialWithPassphrase()
+	if err != nil {
+		return err
+	}
+	if passphrase == nil {
+		return errCredentialUnlocked
+	}
+	keys.Encryption = false
+	return saveApiCredential(keys, nil)
+}
 
+func rotateCredentialsPassphrase() error {
+	keys, passphrase, err := loadApiCredentialWithPassphrase()
+	if err != nil {
+		return err
+	}
+	if passphrase == nil {
+		return errCredentialUnlocked
+	}
+	newPassphrase, err := readNewPassphrase()
+	if err != nil {
+		return err
+	}
+	return saveApiCredential(keys, newPassphrase)
 }
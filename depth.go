@@ -0,0 +1,139 @@
+/*
+ * MIT License
+ *
+ * Copyright (c) 2018 Igor Konovalov
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+package main
+
+import (
+	"math"
+	wr "github.com/ikonovalov/global-trade/wrappers"
+	"github.com/shopspring/decimal"
+)
+
+// wallDepthShare is the minimal part of the cumulative quantity up to and including the level
+// which the wall holds alone, so a wall is harder to eat than the levels in front of it.
+var wallDepthShare = decimal.New(25, -2)
+
+type (
+	// depthLevel is the order book level with totals from the best price up to and including it.
+	// Notional values are in quote currency.
+	depthLevel struct {
+		wr.OrderBookLevel
+		Notional           decimal.Decimal
+		CumulativeQuantity decimal.Decimal
+		CumulativeNotional decimal.Decimal
+		ZScore             float64
+		Wall               bool
+	}
+
+	// wallSettings tunes the detection: Sensitivity is the minimal quantity z-score of the wall,
+	// MinNotional is the minimal wall value in quote currency.
+	wallSettings struct {
+		Sensitivity float64
+		MinNotional decimal.Decimal
+	}
+
+	// priceImpact estimates the market order of Amount filled through the visible side of the book.
+	// Impact is the percent of WorstPrice away from the best price, Filled is less than Amount
+	// when the visible book is too thin.
+	priceImpact struct {
+		Side         string
+		Amount       decimal.Decimal
+		Filled       decimal.Decimal
+		AveragePrice decimal.Decimal
+		WorstPrice   decimal.Decimal
+		Impact       decimal.Decimal
+	}
+)
+
+// analyzeDepth computes cumulative totals and quantity z-scores of the side and marks walls.
+// A wall stands out of the visible book by quantity, holds a considerable part of the cumulative
+// depth and is worth MinNotional at least.
+func analyzeDepth(levels []wr.OrderBookLevel, settings wallSettings) []depthLevel {
+	rs := make([]depthLevel, 0, len(levels))
+	var (
+		cumulativeQuantity = decimal.Zero
+		cumulativeNotional = decimal.Zero
+		sum, sumSquares    float64
+	)
+	for _, l := range levels {
+		notional := l.Price.Mul(l.Quantity)
+		cumulativeQuantity = cumulativeQuantity.Add(l.Quantity)
+		cumulativeNotional = cumulativeNotional.Add(notional)
+		rs = append(rs, depthLevel{
+			OrderBookLevel:     l,
+			Notional:           notional,
+			CumulativeQuantity: cumulativeQuantity,
+			CumulativeNotional: cumulativeNotional,
+		})
+		q, _ := l.Quantity.Float64()
+		sum += q
+		sumSquares += q * q
+	}
+	// z-scores of two levels are always +-1, such a book has no walls
+	if len(rs) < 3 {
+		return rs
+	}
+	n := float64(len(rs))
+	mean := sum / n
+	deviation := math.Sqrt(math.Max(sumSquares/n-mean*mean, 0))
+	if deviation == 0 {
+		return rs
+	}
+	for i := range rs {
+		q, _ := rs[i].Quantity.Float64()
+		rs[i].ZScore = (q - mean) / deviation
+		rs[i].Wall = rs[i].ZScore >= settings.Sensitivity &&
+			rs[i].Quantity.GreaterThanOrEqual(rs[i].CumulativeQuantity.Mul(wallDepthShare)) &&
+			rs[i].Notional.GreaterThanOrEqual(settings.MinNotional)
+	}
+	return rs
+}
+
+// estimateImpact walks the side of the book with the market order of amount.
+// Buy orders consume asks, sell orders consume bids.
+func estimateImpact(side string, levels []wr.OrderBookLevel, amount decimal.Decimal) priceImpact {
+	rs := priceImpact{Side: side, Amount: amount, Filled: decimal.Zero}
+	if len(levels) == 0 || amount.Sign() <= 0 {
+		return rs
+	}
+	cost := decimal.Zero
+	for _, l := range levels {
+		rest := amount.Sub(rs.Filled)
+		if rest.Sign() <= 0 {
+			break
+		}
+		take := decimal.Min(rest, l.Quantity)
+		rs.Filled = rs.Filled.Add(take)
+		cost = cost.Add(take.Mul(l.Price))
+		rs.WorstPrice = l.Price
+	}
+	if rs.Filled.Sign() > 0 {
+		rs.AveragePrice = cost.Div(rs.Filled)
+	}
+	best := levels[0].Price
+	if best.Sign() > 0 {
+		rs.Impact = rs.WorstPrice.Sub(best).Div(best).Mul(hundred)
+	}
+	return rs
+}
@@ -25,17 +25,22 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"gopkg.in/alecthomas/kingpin.v2"
 	"io/ioutil"
 	"log"
 	"os"
+	"os/signal"
 	"github.com/ikonovalov/go-yobit"
 	wr "github.com/ikonovalov/global-trade/wrappers"
+	"github.com/shopspring/decimal"
+	"github.com/miguelmota/go-coinmarketcap"
 	. "github.com/logrusorgru/aurora"
 	"strings"
 	"sort"
-	"github.com/miguelmota/go-coinmarketcap"
+	"strconv"
+	"time"
 )
 
 const (
@@ -47,194 +52,826 @@ var (
 
 	app            = kingpin.New("yobit", "Yobit cryptocurrency exchange crafted client.").Version("0.4.0")
 	appVerboseFlag = app.Flag("verbose", "Print additional information").Bool()
+	appExchange    = app.Flag("exchange", "Exchange for market data and trading commands: yobit, bittrex").Short('e').Default("yobit").Enum("yobit", "bittrex")
+	appTimeout     = app.Flag("timeout", "Command timeout, 0 disables it").Default("1m").Duration()
+	appOutput      = app.Flag("output", "Output format: table, json, csv, yaml").Short('o').Default(outputTable).Enum(outputTable, outputJson, outputCsv, outputYaml)
+	appCostMethod  = app.Flag("cost-method", "Cost basis method of the trade ledger: fifo, lifo, average").Default(costFifo).Enum(costFifo, costLifo, costAverage)
 
 	cmdInit       = app.Command("init", "Initialize nonce and keys container")
 	cmdInitSecret = cmdInit.Arg("secret", "API secret").Required().String()
 	cmdInitKey    = cmdInit.Arg("key", "API key").Required().String()
 
-	cmdMarkets      = app.Command("markets", "(m) Show all listed tickers on the Yobit").Alias("m")
+	cmdCredentials                 = app.Command("credentials", "Manage credential container")
+	cmdCredentialsLock             = cmdCredentials.Command("lock", "Encrypt credential container with a passphrase")
+	cmdCredentialsUnlock           = cmdCredentials.Command("unlock", "Decrypt credential container back to plaintext")
+	cmdCredentialsRotatePassphrase = cmdCredentials.Command("rotate-passphrase", "Re-encrypt credential container with a new passphrase")
+
+	cmdCredentialsSet                = cmdCredentials.Command("set", "Set provider credentials keeping the others untouched")
+	cmdCredentialsSetYobit           = cmdCredentialsSet.Command("yobit", "Yobit API key and secret")
+	cmdCredentialsSetYobitKey        = cmdCredentialsSetYobit.Arg("key", "API key").Required().String()
+	cmdCredentialsSetYobitSecret     = cmdCredentialsSetYobit.Arg("secret", "API secret").Required().String()
+	cmdCredentialsSetBittrex         = cmdCredentialsSet.Command("bittrex", "Bittrex API key and secret")
+	cmdCredentialsSetBittrexKey      = cmdCredentialsSetBittrex.Arg("key", "API key").Required().String()
+	cmdCredentialsSetBittrexSecret   = cmdCredentialsSetBittrex.Arg("secret", "API secret").Required().String()
+	cmdCredentialsSetEtherscan       = cmdCredentialsSet.Command("etherscan", "Add Ethereum account to watch")
+	cmdCredentialsSetEtherscanAcc    = cmdCredentialsSetEtherscan.Arg("account", "Ethereum account 0x...").Required().String()
+	cmdCredentialsSetEtherscanKey    = cmdCredentialsSet.Command("etherscan-key", "Etherscan API key")
+	cmdCredentialsSetEtherscanKeyArg = cmdCredentialsSetEtherscanKey.Arg("key", "API key").Required().String()
+	cmdCredentialsSetEtherscanToken  = cmdCredentialsSet.Command("etherscan-token", "Add ERC-20 token to watch on Ethereum accounts")
+	cmdCredentialsSetTokenContract   = cmdCredentialsSetEtherscanToken.Arg("contract", "Token contract address 0x...").Required().String()
+	cmdCredentialsSetTokenSymbol     = cmdCredentialsSetEtherscanToken.Arg("symbol", "Token symbol as listed on CoinMarketCap: OMG, BNB and so on").Required().String()
+	cmdCredentialsSetTokenDecimals   = cmdCredentialsSetEtherscanToken.Arg("decimals", "Token decimals").Default("18").Int32()
+	cmdCredentialsSetBlockCypher     = cmdCredentialsSet.Command("blockcypher", "Add cold wallet address to watch")
+	cmdCredentialsSetBlockCypherCoin = cmdCredentialsSetBlockCypher.Arg("coin", "btc, ltc, doge, dash").Required().Enum(wr.BlockCypherCoins()...)
+	cmdCredentialsSetBlockCypherAddr = cmdCredentialsSetBlockCypher.Arg("address", "Wallet address").Required().String()
+
+	cmdCredentialsLabel        = cmdCredentials.Command("label", "Name the watched Etherscan account or BlockCypher address")
+	cmdCredentialsLabelAddress = cmdCredentialsLabel.Arg("address", "Watched address").Required().String()
+	cmdCredentialsLabelName    = cmdCredentialsLabel.Arg("label", "Label, removed if omitted").Default("").String()
+
+	cmdCredentialsRemove         = cmdCredentials.Command("remove", "Remove provider credentials or a single watched account")
+	cmdCredentialsRemoveProvider = cmdCredentialsRemove.Arg("provider", "yobit, bittrex, etherscan, blockcypher").Required().Enum("yobit", "bittrex", "etherscan", "blockcypher")
+	cmdCredentialsRemoveEntry    = cmdCredentialsRemove.Arg("entry", "Etherscan account or token, BlockCypher address. Whole section is removed if omitted.").Default("").String()
+
+	cmdMarkets      = app.Command("markets", "(m) Show all listed markets of the exchange").Alias("m")
 	cmdInfoCurrency = cmdMarkets.Arg("cryptocurrency", "Show markets only for specified currency: btc, eth, usd and so on.").Default("").String()
 
-	cmdTicker     = app.Command("ticker", "(tc) Command provides statistic data for the last 24 hours.").Alias("tc")
-	cmdTickerPair = cmdTicker.Arg("pairs", "Listing ticker name. eth_btc, xem_usd, and so on.").Default(defaultPair).String()
+	cmdTicker      = app.Command("ticker", "(tc) Command provides statistic data for the last 24 hours.").Alias("tc")
+	cmdTickerPair  = pairsArg(cmdTicker.Arg("pairs", "Listing ticker names: eth_btc xem_usd or eth_btc-xem_usd").Default(defaultPair))
+	cmdTickerWatch = cmdTicker.Flag("watch", "Re-poll every interval and redraw in place: 5s, 1m").Duration()
 
-	cmdDepth      = app.Command("depth", "(d) Command returns information about lists of active orders for selected pairs.").Alias("d")
-	cmdDepthPair  = cmdDepth.Arg("pairs", "eth_btc, xem_usd and so on.").Default("defaultPair").String()
-	cmdDepthLimit = cmdDepth.Arg("limit", "Depth output limit").Default("20").Int()
+	cmdDepth             = app.Command("depth", "(d) Command returns information about lists of active orders for selected pairs.").Alias("d")
+	cmdDepthPair         = pairArg(cmdDepth.Arg("pairs", "eth_btc, xem_usd and so on.").Default(defaultPair))
+	cmdDepthLimit        = cmdDepth.Arg("limit", "Depth output limit").Default("20").Int()
+	cmdDepthSensitivity  = cmdDepth.Flag("sensitivity", "Minimal quantity z-score of a wall, lower finds more walls").Default("2").Float64()
+	cmdDepthWallNotional = decimalArg(cmdDepth.Flag("wall-notional", "Minimal wall value in quote currency").Default("0"))
+	cmdDepthImpact       = decimalArg(cmdDepth.Flag("impact", "Estimate price impact of the market order of the amount in base currency"))
+	cmdDepthWatch        = cmdDepth.Flag("watch", "Re-poll every interval and redraw in place: 5s, 1m").Duration()
 
 	cmdTrades      = app.Command("trades", "(tr) Command returns information about the last transactions of selected pairs.").Alias("tr")
-	cmdTradesPair  = cmdTrades.Arg("pairs", "waves_btc, dash_usd and so on.").Default(defaultPair).String()
+	cmdTradesPair  = pairArg(cmdTrades.Arg("pairs", "waves_btc, dash_usd and so on.").Default(defaultPair))
 	cmdTradesLimit = cmdTrades.Arg("limit", "Trades output limit.").Default("100").Int()
-
-	cmdWallets = app.Command("wallets", "(w) Command returns information about user's balances and privileges of API-key as well as server time.").Alias("w")
+	cmdTradesWatch = cmdTrades.Flag("watch", "Re-poll every interval and redraw in place: 5s, 1m").Duration()
+
+	cmdWallets           = app.Command("wallets", "(w) Command returns information about user's balances and privileges of API-key as well as server time.").Alias("w")
+	cmdWalletsByAddress  = cmdWallets.Flag("by-address", "Show every cold wallet address under its summary").Bool()
+	cmdWalletsNoSnapshot = cmdWallets.Flag("no-snapshot", "Do not record the portfolio snapshot").Bool()
+	cmdWalletsWatch      = cmdWallets.Flag("watch", "Re-poll every interval and redraw in place, snapshots are not recorded").Duration()
+
+	cmdPnl         = app.Command("pnl", "Cost basis and realized/unrealized PnL of the trade ledger")
+	cmdPnlPairs    = pairsArg(cmdPnl.Arg("pairs", "Pairs to import trade history for: eth_btc, doge_usd... Ledger pairs are used if omitted."))
+	cmdPnlNoImport = cmdPnl.Flag("no-import", "Use fills already in the ledger, do not query exchanges").Bool()
+
+	cmdTaxReport         = app.Command("tax-report", "Disposals of the year matched to acquisition lots, use -o csv for accounting")
+	cmdTaxReportYear     = cmdTaxReport.Flag("year", "Calendar year of disposals").Default(strconv.Itoa(time.Now().Year())).Int()
+	cmdTaxReportPairs    = pairsArg(cmdTaxReport.Arg("pairs", "Pairs to import trade history for. Ledger pairs are used if omitted."))
+	cmdTaxReportNoImport = cmdTaxReport.Flag("no-import", "Use fills already in the ledger, do not query exchanges").Bool()
+
+	cmdArb          = app.Command("arb", "Arbitrage opportunities between exchanges ranked by the spread net of fees")
+	cmdArbPairs     = pairsArg(cmdArb.Arg("pairs", "Pairs to check: eth_btc, ltc_btc... All pairs listed on several exchanges if omitted."))
+	cmdArbTop       = cmdArb.Flag("top", "Number of best ticker spreads to verify against order books").Default("10").Int()
+	cmdArbMinSpread = decimalArg(cmdArb.Flag("min-spread", "Minimal net spread in percents").Default("0"))
+
+	cmdTui        = app.Command("tui", "Full screen terminal UI: tickers, order book, trades, open orders and wallets")
+	cmdTuiPairs   = pairsArg(cmdTui.Arg("pairs", "Pairs of the ticker list: eth_btc, ltc_btc..."))
+	cmdTuiRefresh = cmdTui.Flag("refresh", "Market data refresh interval").Default("5s").Duration()
+
+	cmdSnapshot     = app.Command("snapshot", "Portfolio snapshots history")
+	cmdSnapshotTake = cmdSnapshot.Command("take", "Record current holdings without printing wallets").Default()
+	cmdSnapshotList = cmdSnapshot.Command("list", "List recorded snapshots")
+	cmdSnapshotDiff = cmdSnapshot.Command("diff", "Changes in holdings and value between two snapshots")
+	cmdSnapshotFrom = cmdSnapshotDiff.Arg("from", "Snapshot id, date 2006-01-02[T15:04] or latest").Required().String()
+	cmdSnapshotTo   = cmdSnapshotDiff.Arg("to", "Snapshot id, date 2006-01-02[T15:04] or latest").Default("latest").String()
 
 	cmdActiveOrders    = app.Command("active-orders", "(ao) Show active orders").Alias("ao")
-	cmdActiveOrderPair = cmdActiveOrders.Arg("pair", "doge_usd...").Required().String()
+	cmdActiveOrderPair = pairArg(cmdActiveOrders.Arg("pair", "doge_usd...").Required())
 
 	cmdOrderInfo   = app.Command("order", "(o) Detailed information about the chosen order").Alias("o")
 	cmdOrderInfoId = cmdOrderInfo.Arg("id", "Order id").Required().String()
 
 	cmdTradeHistory     = app.Command("trade-history", "(th) Trade history").Alias("th")
-	cmdTradeHistoryPair = cmdTradeHistory.Arg("pair", "doge_usd...").Required().String()
-
-	cmdBuy       = app.Command("buy", "(b) Buy on stock exchange").Alias("b")
-	cmdBuyPair   = cmdBuy.Arg("pair", "Pair").Required().String()
-	cmdBuyRate   = cmdBuy.Arg("rate", "Exchange rate for buying or selling").Required().Float64()
-	cmdBuyAmount = cmdBuy.Arg("amount", "Exchange rate for buying or selling").Required().Float64()
-
-	cmdSell       = app.Command("sell", "(s) Sell on stock exchange").Alias("s")
-	cmdSellPair   = cmdSell.Arg("pair", "Pair").Required().String()
-	cmdSellRate   = cmdSell.Arg("rate", "Exchange rate for buying or selling").Required().Float64()
-	cmdSellAmount = cmdSell.Arg("amount", "Exchange rate for buying or selling").Required().Float64()
+	cmdTradeHistoryPair = pairArg(cmdTradeHistory.Arg("pair", "doge_usd...").Required())
+
+	cmdBuy             = app.Command("buy", "(b) Buy on stock exchange").Alias("b")
+	cmdBuyPair         = pairArg(cmdBuy.Arg("pair", "Pair eth_btc...").Required())
+	cmdBuyRate         = decimalArg(cmdBuy.Arg("rate", "Exchange rate for buying or selling").Required())
+	cmdBuyAmount       = decimalArg(cmdBuy.Arg("amount", "Exchange rate for buying or selling").Required())
+	cmdBuyDryRun       = cmdBuy.Flag("dry-run", "Check the order without placing it").Bool()
+	cmdBuyYes          = cmdBuy.Flag("yes", "Do not ask for the confirmation").Short('y').Bool()
+	cmdBuyMaxDeviation = decimalArg(cmdBuy.Flag("max-deviation", "Refuse the rate more than N percent worse than the last price, 0 disables").Default("10"))
+
+	cmdSell             = app.Command("sell", "(s) Sell on stock exchange").Alias("s")
+	cmdSellPair         = pairArg(cmdSell.Arg("pair", "Pair eth_btc...").Required())
+	cmdSellRate         = decimalArg(cmdSell.Arg("rate", "Exchange rate for buying or selling").Required())
+	cmdSellAmount       = decimalArg(cmdSell.Arg("amount", "Exchange rate for buying or selling").Required())
+	cmdSellDryRun       = cmdSell.Flag("dry-run", "Check the order without placing it").Bool()
+	cmdSellYes          = cmdSell.Flag("yes", "Do not ask for the confirmation").Short('y').Bool()
+	cmdSellMaxDeviation = decimalArg(cmdSell.Flag("max-deviation", "Refuse the rate more than N percent worse than the last price, 0 disables").Default("10"))
 
 	cmdCancelOrder        = app.Command("cancel", "(c) Cancels the chosen order").Alias("c")
 	cmdCancelOrderOrderId = cmdCancelOrder.Arg("order_id", "Order ID").Required().String()
+	cmdCancelOrderDryRun  = cmdCancelOrder.Flag("dry-run", "Show the order without cancelling it").Bool()
+	cmdCancelOrderYes     = cmdCancelOrder.Flag("yes", "Do not ask for the confirmation").Short('y').Bool()
+
+	cmdStop        = app.Command("stop", "Stop-loss: place the limit order once the last price crosses the trigger, see daemon")
+	cmdStopPair    = pairArg(cmdStop.Arg("pair", "Pair eth_btc...").Required())
+	cmdStopTrigger = decimalArg(cmdStop.Arg("trigger", "Last price firing the order").Required())
+	cmdStopRate    = decimalArg(cmdStop.Arg("rate", "Limit order rate").Required())
+	cmdStopAmount  = decimalArg(cmdStop.Arg("amount", "Limit order amount").Required())
+	cmdStopSide    = cmdStop.Flag("side", "Order side: sell fires below the trigger, buy above it").Default(wr.SideSell).Enum(wr.SideSell, wr.SideBuy)
+
+	cmdTakeProfit        = app.Command("take-profit", "Take-profit: place the limit order once the last price crosses the trigger, see daemon")
+	cmdTakeProfitPair    = pairArg(cmdTakeProfit.Arg("pair", "Pair eth_btc...").Required())
+	cmdTakeProfitTrigger = decimalArg(cmdTakeProfit.Arg("trigger", "Last price firing the order").Required())
+	cmdTakeProfitRate    = decimalArg(cmdTakeProfit.Arg("rate", "Limit order rate").Required())
+	cmdTakeProfitAmount  = decimalArg(cmdTakeProfit.Arg("amount", "Limit order amount").Required())
+	cmdTakeProfitSide    = cmdTakeProfit.Flag("side", "Order side: sell fires above the trigger, buy below it").Default(wr.SideSell).Enum(wr.SideSell, wr.SideBuy)
+
+	cmdTrailingStop       = app.Command("trailing-stop", "Trailing stop: follow the best price and place the limit order once it retraces by the trail, see daemon")
+	cmdTrailingStopPair   = pairArg(cmdTrailingStop.Arg("pair", "Pair eth_btc...").Required())
+	cmdTrailingStopTrail  = trailArg(cmdTrailingStop.Arg("trail", "Retracement firing the order: quote amount 0.001 or percents 5%").Required())
+	cmdTrailingStopAmount = decimalArg(cmdTrailingStop.Arg("amount", "Limit order amount").Required())
+	cmdTrailingStopSide   = cmdTrailingStop.Flag("side", "Order side: sell follows the high, buy follows the low").Default(wr.SideSell).Enum(wr.SideSell, wr.SideBuy)
+	cmdTrailingStopPrice  = cmdTrailingStop.Flag("price", "Followed ticker price: last or buy (the best bid)").Default(priceLast).Enum(priceLast, priceBuy)
+	cmdTrailingStopOffset = decimalArg(cmdTrailingStop.Flag("offset", "Limit order rate is N percent worse than the price firing it").Default("0.5"))
+
+	cmdOco       = app.Command("oco", "One-cancels-other: place the take limit order and a stop cancelling it, see daemon")
+	cmdOcoPair   = pairArg(cmdOco.Arg("pair", "Pair eth_btc...").Required())
+	cmdOcoAmount = decimalArg(cmdOco.Arg("amount", "Order amount").Required())
+	cmdOcoTake   = decimalArg(cmdOco.Flag("take", "Take limit order rate").Required())
+	cmdOcoStop   = decimalArg(cmdOco.Flag("stop", "Last price firing the stop").Required())
+	cmdOcoSide   = cmdOco.Flag("side", "Order side: sell takes above the last price and stops below it, buy the opposite").Default(wr.SideSell).Enum(wr.SideSell, wr.SideBuy)
+	cmdOcoOffset = decimalArg(cmdOco.Flag("offset", "Stop order rate is N percent worse than the stop price").Default("0.5"))
+	cmdOcoDryRun = cmdOco.Flag("dry-run", "Check the orders without placing them").Bool()
+	cmdOcoYes    = cmdOco.Flag("yes", "Do not ask for the confirmation").Short('y').Bool()
+
+	cmdTwap         = app.Command("twap", "Execute the order in child limit orders spread evenly over the duration")
+	cmdTwapPair     = pairArg(cmdTwap.Arg("pair", "Pair eth_btc...").Required())
+	cmdTwapSide     = cmdTwap.Arg("side", "Order side: buy or sell").Required().Enum(wr.SideBuy, wr.SideSell)
+	cmdTwapAmount   = decimalArg(cmdTwap.Arg("total-amount", "Parent order amount").Required())
+	cmdTwapLimit    = decimalArg(cmdTwap.Flag("limit", "Worst rate of child orders").Required())
+	cmdTwapDuration = cmdTwap.Flag("duration", "Execution duration").Default("1h").Duration()
+	cmdTwapSlices   = cmdTwap.Flag("slices", "Number of slices").Default("10").Int()
+	cmdTwapVisible  = decimalArg(cmdTwap.Flag("visible", "Iceberg: the largest child order amount shown in the book, 0 shows the whole slice").Default("0"))
+	cmdTwapDryRun   = cmdTwap.Flag("dry-run", "Check the order and show the plan without placing it").Bool()
+	cmdTwapYes      = cmdTwap.Flag("yes", "Do not ask for the confirmation").Short('y').Bool()
+
+	cmdTriggers         = app.Command("triggers", "Stop-loss, take-profit, trailing stop and OCO triggers")
+	cmdTriggersList     = cmdTriggers.Command("list", "List pending triggers").Default()
+	cmdTriggersListAll  = cmdTriggersList.Flag("all", "Include fired, failed and cancelled triggers").Bool()
+	cmdTriggersCancel   = cmdTriggers.Command("cancel", "Cancel the pending trigger")
+	cmdTriggersCancelId = cmdTriggersCancel.Arg("id", "Trigger id").Required().Uint64()
+	cmdTriggersLog      = cmdTriggers.Command("log", "Event log of triggers: creation, trailing adjustments and status changes")
+	cmdTriggersLogId    = cmdTriggersLog.Arg("id", "Trigger id, all triggers when omitted").Uint64()
+
+	cmdDaemon         = app.Command("daemon", "Watch tickers and OCO orders, move trailing stops and fire triggers until Ctrl-C")
+	cmdDaemonInterval = cmdDaemon.Flag("interval", "Tickers poll interval").Default("10s").Duration()
+
+	// watchFlags are poll intervals of repeating commands, --timeout applies to every poll of them
+	watchFlags = map[string]*time.Duration{
+		"tui":     cmdTuiRefresh,
+		"ticker":  cmdTickerWatch,
+		"depth":   cmdDepthWatch,
+		"trades":  cmdTradesWatch,
+		"wallets": cmdWalletsWatch,
+		"daemon":  cmdDaemonInterval,
+	}
+
+	// publicCommands read market data only, the credential container isn't decrypted for them
+	publicCommands = map[string]bool{"markets": true, "ticker": true, "depth": true, "trades": true}
 )
 
 func main() {
 
 	command := kingpin.MustParse(app.Parse(os.Args[1:]))
 
+	setupOutput()
+
 	// setup logging
 	if !*appVerboseFlag {
 		log.SetFlags(0)
 		log.SetOutput(ioutil.Discard)
 	}
 
-	credential, err := loadApiCredential()
-	if err != nil {
-		log.Println("Credential not set. You can't use trading API.")
-		credential = GlobalCredentials{}
+	// credential container management doesn't need exchange clients
+	switch command {
+	case "init":
+		if err := setYobitCredential(*cmdInitKey, *cmdInitSecret); err != nil {
+			fatal(err)
+		}
+		yobit.CreateNonceFileIfNotExists()
+		yobit.WriteNonce([]byte("1"))
+		return
+	case "credentials lock":
+		if err := lockCredentials(); err != nil {
+			fatal(err)
+		}
+		fmt.Println("Credentials encrypted")
+		return
+	case "credentials unlock":
+		if err := unlockCredentials(); err != nil {
+			fatal(err)
+		}
+		fmt.Println("Credentials decrypted")
+		return
+	case "credentials rotate-passphrase":
+		if err := rotateCredentialsPassphrase(); err != nil {
+			fatal(err)
+		}
+		fmt.Println("Passphrase changed")
+		return
+	case "credentials set yobit":
+		if err := setYobitCredential(*cmdCredentialsSetYobitKey, *cmdCredentialsSetYobitSecret); err != nil {
+			fatal(err)
+		}
+		return
+	case "credentials set bittrex":
+		if err := setBittrexCredential(*cmdCredentialsSetBittrexKey, *cmdCredentialsSetBittrexSecret); err != nil {
+			fatal(err)
+		}
+		return
+	case "credentials set etherscan":
+		if err := addEtherscanAccount(*cmdCredentialsSetEtherscanAcc); err != nil {
+			fatal(err)
+		}
+		return
+	case "credentials set etherscan-key":
+		if err := setEtherscanApiKey(*cmdCredentialsSetEtherscanKeyArg); err != nil {
+			fatal(err)
+		}
+		return
+	case "credentials set etherscan-token":
+		if err := addEtherscanToken(*cmdCredentialsSetTokenContract, *cmdCredentialsSetTokenSymbol, *cmdCredentialsSetTokenDecimals); err != nil {
+			fatal(err)
+		}
+		return
+	case "credentials set blockcypher":
+		if err := addBlockCypherAddress(*cmdCredentialsSetBlockCypherCoin, *cmdCredentialsSetBlockCypherAddr); err != nil {
+			fatal(err)
+		}
+		return
+	case "credentials label":
+		if err := labelAddress(*cmdCredentialsLabelAddress, *cmdCredentialsLabelName); err != nil {
+			fatal(err)
+		}
+		return
+	case "credentials remove":
+		if err := removeCredential(*cmdCredentialsRemoveProvider, *cmdCredentialsRemoveEntry); err != nil {
+			fatal(err)
+		}
+		return
+	case "snapshot list":
+		snapshots, err := listSnapshots()
+		if err != nil {
+			fatal(err)
+		}
+		render(snapshotRecords(snapshots), func() {
+			printSnapshots(snapshots)
+		})
+		return
+	case "snapshot diff":
+		from, err := findSnapshot(*cmdSnapshotFrom)
+		if err != nil {
+			fatal(err)
+		}
+		to, err := findSnapshot(*cmdSnapshotTo)
+		if err != nil {
+			fatal(err)
+		}
+		diff := diffSnapshots(from, to)
+		render(diff, func() {
+			printSnapshotDiff(from, to, diff)
+		})
+		return
+	case "triggers list":
+		triggers, err := listTriggers(*cmdTriggersListAll)
+		if err != nil {
+			fatal(err)
+		}
+		render(triggerRecords(triggers), func() {
+			printTriggers(triggers)
+		})
+		return
+	case "triggers cancel":
+		trigger, err := cancelTrigger(*cmdTriggersCancelId)
+		if err != nil {
+			fatal(err)
+		}
+		render(triggerRecords([]conditionalOrder{trigger}), func() {
+			printTriggers([]conditionalOrder{trigger})
+		})
+		return
+	case "triggers log":
+		events, err := listTriggerEvents(*cmdTriggersLogId)
+		if err != nil {
+			fatal(err)
+		}
+		render(triggerEventRecords(events), func() {
+			printTriggerEvents(events)
+		})
+		return
 	}
 
-	// create exchanges client/wrappers
+	var credential GlobalCredentials
+	if !publicCommands[command] {
+		loaded, err := loadApiCredential()
+		if os.IsNotExist(err) {
+			log.Println("Credential not set. You can't use trading API.")
+		} else if err != nil {
+			fatal(err)
+		}
+		credential = loaded
+	}
 
-	cmc := wr.CoinMarketCap{}
+	// command context is cancelled on timeout or Ctrl-C, watched and confirmed commands apply timeout to every call
+	timeout := *appTimeout
+	if watchFlag, ok := watchFlags[command]; ok && *watchFlag > 0 || confirmedCommands[command] {
+		timeout = 0
+	}
+	ctx, cancel := commandContext(timeout)
+	defer cancel()
+
+	// create exchanges client/wrappers
 
 	newYobit := wr.NewYobit(credential.Yobit)
-	yob2 := wr.Exchange{CryptCurrencyExchange: newYobit}
-	btrx := wr.Exchange{CryptCurrencyExchange: wr.NewBittrex(credential.Bittrex)}
+	yob2 := wr.Exchange{CryptCurrencyExchange: newYobit, Name: "Yobit", Link: yobit.Url, PollInterval: wr.YobitPollInterval}
+	newBittrex, err := wr.NewBittrex(ctx, credential.Bittrex)
+	if err != nil {
+		fatal(err)
+	}
+	btrx := wr.Exchange{CryptCurrencyExchange: newBittrex, Name: "Bittrex", Link: "https://bittrex.com", PollInterval: wr.BittrexPollInterval}
 
-	defer yob2.Release()
-	defer btrx.Release()
+	onRelease(yob2.Release, btrx.Release)
+	defer release()
 
-	yobt := newYobit.Direct()
+	exchanges := map[string]wr.Exchange{"yobit": yob2, "bittrex": btrx}
+	exchange := exchanges[*appExchange]
 
 	switch command {
-	case "init":
-		{
-			createCredentialFile(yobit.ApiCredential{Secret: *cmdInitSecret, Key: *cmdInitKey})
-			yobit.CreateNonceFileIfNotExists()
-			yobit.WriteNonce([]byte("1"))
-		}
 	case "markets":
 		{
-			channel := make(chan yobit.InfoResponse)
-			go yobt.Info(channel)
-			infoResponse := <-channel
-			printInfoRecords(infoResponse, *cmdInfoCurrency)
-			fmt.Printf("\nTotal markets %d\n", len(infoResponse.Pairs))
+			channel := make(chan wr.MarketsResponse, 1)
+			go exchange.Markets(ctx, channel)
+			rs := <-channel
+			if rs.Err != nil {
+				fatal(rs.Err)
+			}
+			render(marketRecords(rs.Markets, *cmdInfoCurrency), func() {
+				printMarkets(rs.Markets, *cmdInfoCurrency)
+				fmt.Fprintf(stdout, "\nTotal markets %d\n", len(rs.Markets))
+			})
 		}
 	case "ticker":
+		watch(ctx, watchInterval(*cmdTickerWatch, exchange.PollInterval), func(ctx context.Context) error {
+			channel := make(chan wr.TickersResponse, 1)
+			go exchange.GetTickers(ctx, *cmdTickerPair, channel)
+			rs := <-channel
+			if rs.Err != nil {
+				return rs.Err
+			}
+			render(tickerRecords(rs.Tickers), func() {
+				for _, pair := range *cmdTickerPair {
+					if ticker, ok := rs.Tickers[pair]; ok {
+						printTicker(ticker, pair)
+					}
+				}
+			})
+			return nil
+		})
+	case "depth":
+		watch(ctx, watchInterval(*cmdDepthWatch, exchange.PollInterval), func(ctx context.Context) error {
+			channel := make(chan wr.OrderBookResponse, 1)
+			go exchange.OrderBook(ctx, *cmdDepthPair, *cmdDepthLimit, channel)
+			rs := <-channel
+			if rs.Err != nil {
+				return rs.Err
+			}
+			settings := wallSettings{Sensitivity: *cmdDepthSensitivity, MinNotional: *cmdDepthWallNotional}
+			render(offerRecords(rs.OrderBook, settings), func() {
+				printOffers(rs.OrderBook, settings, *cmdDepthImpact)
+			})
+			return nil
+		})
+	case "trades":
+		watch(ctx, watchInterval(*cmdTradesWatch, exchange.PollInterval), func(ctx context.Context) error {
+			channel := make(chan wr.TradesResponse, 1)
+			go exchange.Trades(ctx, *cmdTradesPair, *cmdTradesLimit, channel)
+			rs := <-channel
+			if rs.Err != nil {
+				return rs.Err
+			}
+			render(tradeRecords(rs.Trades), func() {
+				fmt.Fprintln(stdout, Bold(strings.ToUpper(*cmdTradesPair)))
+				printTrades(rs.Trades)
+			})
+			return nil
+		})
+	case "wallets":
+		interval := watchInterval(*cmdWalletsWatch, walletsPollInterval(credential, []wr.Exchange{yob2, btrx})...)
+		watch(ctx, interval, func(ctx context.Context) error {
+			report := fetchWallets(ctx, credential, []wr.Exchange{yob2, btrx}, *cmdWalletsByAddress)
+			fills, err := loadLedger()
+			if err != nil {
+				log.Printf("Trade ledger is not loaded: %s", err)
+			}
+			costsUsd := coinCostsUsd(buildPositions(fills, *appCostMethod))
+			render(walletRecords(report.Coins, report.Balances, costsUsd, true), func() {
+				printWallets(report.Coins, report.Balances, costsUsd, true)
+			})
+			printSourceErrors(report.Errors)
+			if !*cmdWalletsNoSnapshot && interval == 0 {
+				if _, err := saveSnapshot(report); err != nil {
+					log.Printf("Snapshot is not saved: %s", err)
+				}
+			}
+			return nil
+		})
+	case "snapshot take":
 		{
-			channel := make(chan yobit.TickerInfoResponse)
-			go yobt.Tickers24([]string{strings.ToLower(*cmdTickerPair)}, channel)
-			tickerResponse := <-channel
-
-			for ticker, v := range tickerResponse.Tickers {
-				printTicker(v, ticker)
+			report := fetchWallets(ctx, credential, []wr.Exchange{yob2, btrx}, false)
+			snapshot, err := saveSnapshot(report)
+			if err != nil {
+				fatal(err)
 			}
+			render(snapshotRecords([]portfolioSnapshot{snapshot}), func() {
+				printSnapshots([]portfolioSnapshot{snapshot})
+			})
+			printSourceErrors(report.Errors)
 		}
-	case "depth":
+	case "pnl":
 		{
-			channel := make(chan yobit.DepthResponse)
-			go yobt.DepthLimited(strings.ToLower(*cmdDepthPair), *cmdDepthLimit, channel)
-			depthResponse := <-channel
-			offers := depthResponse.Offers[*cmdDepthPair]
-			printOffers(offers)
+			cmc := wr.CoinMarketCap{}
+			cmcMarketChannel := make(chan wr.MarketDataResponse, 1)
+			go cmc.GetMarketData(ctx, cmcMarketChannel)
+			marketData := <-cmcMarketChannel
+			fills, sourceErrors, err := refreshLedger(ctx, []wr.Exchange{yob2, btrx}, *cmdPnlPairs, marketData.Coins, *cmdPnlNoImport)
+			if err != nil {
+				fatal(err)
+			}
+			if marketData.Err != nil {
+				sourceErrors = append(sourceErrors, marketData.Err)
+			}
 
+			positions := buildPositions(fills, *appCostMethod)
+			records := pnlRecords(positions, marketData.Coins, *appCostMethod)
+			unmatched, unvalued := false, false
+			for _, r := range records {
+				unmatched = unmatched || r.Unmatched.Sign() > 0
+				unvalued = unvalued || r.Unvalued
+			}
+			render(records, func() {
+				printPnl(records, unmatched, unvalued)
+			})
+			printSourceErrors(sourceErrors)
 		}
-	case "trades":
+	case "tax-report":
 		{
-			channel := make(chan yobit.TradesResponse)
-			go yobt.TradesLimited(strings.ToLower(*cmdTradesPair), *cmdTradesLimit, channel)
-			tradesResponse := <-channel
-			for ticker, trades := range tradesResponse.Trades {
-				fmt.Println(Bold(strings.ToUpper(ticker)))
-				printTrades(trades)
+			cmc := wr.CoinMarketCap{}
+			cmcMarketChannel := make(chan wr.MarketDataResponse, 1)
+			go cmc.GetMarketData(ctx, cmcMarketChannel)
+			marketData := <-cmcMarketChannel
+			fills, sourceErrors, err := refreshLedger(ctx, []wr.Exchange{yob2, btrx}, *cmdTaxReportPairs, marketData.Coins, *cmdTaxReportNoImport)
+			if err != nil {
+				fatal(err)
 			}
+			if marketData.Err != nil {
+				sourceErrors = append(sourceErrors, marketData.Err)
+			}
+			disposals, unmatched, unvalued := yearDisposals(buildPositions(fills, *appCostMethod), *cmdTaxReportYear)
+			records := taxLotRecords(disposals)
+			render(records, func() {
+				printTaxReport(*cmdTaxReportYear, records)
+			})
+			printErrors("Unmatched sales", unmatched)
+			printErrors("Unvalued sales", unvalued)
+			printSourceErrors(sourceErrors)
 		}
-	case "wallets":
+	case "tui":
 		{
-			balancesChannel := make(chan wr.Balance, 2)
-			cmcMarketChannel := make(chan map[string]coinmarketcap.Coin)
-			etherScanChannel := make(chan wr.EthereumBalances)
-			litecoinChannel := make(chan wr.BlochCypherBalances)
-
-			// get EtherScan accounting data
-			go wr.GetEthereumBalances(credential.Etherscan.Accounts, etherScanChannel)
-
-			// get LTC from Blockcyper.com
-			go wr.GetLiteCoinBalances(credential.BlockCypher.LTC, litecoinChannel)
-
-			// get CoinMarketCup market data
-			go cmc.GetMarketData(cmcMarketChannel)
-
-			// launch GetBalances
-			for _, exc := range []wr.Exchange{yob2, btrx} {
-				go exc.GetBalances(balancesChannel)
+			pairs := *cmdTuiPairs
+			if len(pairs) == 0 {
+				pairs = []string{defaultPair}
+			}
+			interval := watchInterval(*cmdTuiRefresh, exchange.PollInterval*tuiMarketCalls)
+			if err := runTui(ctx, exchange, []wr.Exchange{yob2, btrx}, credential, pairs, interval); err != nil {
+				fatal(err)
 			}
-
-			allBalances := []wr.Balance{<-balancesChannel, <-balancesChannel, (<-etherScanChannel).SummaryBalance(), (<-litecoinChannel).SummaryBalance()}
-			sort.Sort(wr.ByExchangeName{allBalances})
-
-			printWallets(<-cmcMarketChannel, allBalances, true)
+		}
+	case "arb":
+		{
+			opportunities, sourceErrors := scanArbitrage(ctx, []wr.Exchange{yob2, btrx}, *cmdArbPairs, *cmdArbTop, *cmdArbMinSpread)
+			records := arbRecords(opportunities)
+			render(records, func() {
+				printArb(records)
+			})
+			printSourceErrors(sourceErrors)
 		}
 	case "active-orders":
 		{
-			channel := make(chan yobit.ActiveOrdersResponse)
-			go yobt.ActiveOrders(*cmdActiveOrderPair, channel)
-			activeOrders := <-channel
-			printActiveOrders(activeOrders)
-
+			channel := make(chan wr.OrdersResponse)
+			go exchange.OpenOrders(ctx, *cmdActiveOrderPair, channel)
+			rs := <-channel
+			if rs.Err != nil {
+				fatal(rs.Err)
+			}
+			render(orderRecords(rs.Orders), func() {
+				printActiveOrders(rs.Orders)
+			})
 		}
 	case "order":
 		{
-			channel := make(chan yobit.OrderInfoResponse)
-			go yobt.OrderInfo(*cmdOrderInfoId, channel)
-			order := <-channel
-			printOrderInfo(order.Orders)
+			channel := make(chan wr.OrderInfoResponse)
+			go exchange.OrderInfo(ctx, *cmdOrderInfoId, channel)
+			rs := <-channel
+			if rs.Err != nil {
+				fatal(rs.Err)
+			}
+			render(orderRecords([]wr.Order{rs.Order}), func() {
+				printOrderInfo(rs.Order)
+			})
 		}
 	case "trade-history":
 		{
-			channel := make(chan yobit.TradeHistoryResponse)
-			go yobt.TradeHistory(*cmdTradeHistoryPair, channel)
-			history := <-channel
-			printTradeHistory(history)
+			channel := make(chan wr.TradeHistoryResponse)
+			go exchange.TradeHistory(ctx, *cmdTradeHistoryPair, channel)
+			rs := <-channel
+			if rs.Err != nil {
+				fatal(rs.Err)
+			}
+			render(fillRecords(rs.Fills), func() {
+				printTradeHistory(rs.Fills)
+			})
 		}
 	case "buy":
+		placeOrder(ctx, exchange, *cmdBuyPair, wr.SideBuy, *cmdBuyRate, *cmdBuyAmount,
+			orderSafeguards{DryRun: *cmdBuyDryRun, Yes: *cmdBuyYes, MaxDeviation: *cmdBuyMaxDeviation})
+	case "sell":
+		placeOrder(ctx, exchange, *cmdSellPair, wr.SideSell, *cmdSellRate, *cmdSellAmount,
+			orderSafeguards{DryRun: *cmdSellDryRun, Yes: *cmdSellYes, MaxDeviation: *cmdSellMaxDeviation})
+	case "cancel":
+		cancelOrder(ctx, exchange, *cmdCancelOrderOrderId, orderSafeguards{DryRun: *cmdCancelOrderDryRun, Yes: *cmdCancelOrderYes})
+	case "stop":
+		{
+			trigger, err := newTrigger(ctx, exchange,
+				priceTrigger(*appExchange, triggerStop, *cmdStopPair, *cmdStopSide, *cmdStopTrigger, *cmdStopRate, *cmdStopAmount))
+			if err != nil {
+				fatal(err)
+			}
+			render(triggerRecords([]conditionalOrder{trigger}), func() {
+				printTriggers([]conditionalOrder{trigger})
+			})
+		}
+	case "take-profit":
 		{
-			channel := make(chan yobit.TradeResponse)
-			go yobt.Trade(*cmdBuyPair, "buy", *cmdBuyRate, *cmdBuyAmount, channel)
-			trade := <-channel
-			printTradeResult(trade.Result)
+			trigger, err := newTrigger(ctx, exchange,
+				priceTrigger(*appExchange, triggerTakeProfit, *cmdTakeProfitPair, *cmdTakeProfitSide, *cmdTakeProfitTrigger, *cmdTakeProfitRate, *cmdTakeProfitAmount))
+			if err != nil {
+				fatal(err)
+			}
+			render(triggerRecords([]conditionalOrder{trigger}), func() {
+				printTriggers([]conditionalOrder{trigger})
+			})
 		}
-	case "sell":
+	case "trailing-stop":
 		{
-			channel := make(chan yobit.TradeResponse)
-			go yobt.Trade(*cmdSellPair, "sell", *cmdSellRate, *cmdSellAmount, channel)
-			trade := <-channel
-			printTradeResult(trade.Result)
+			trigger, err := newTrigger(ctx, exchange, trailingStop(*appExchange, *cmdTrailingStopPair, *cmdTrailingStopSide,
+				*cmdTrailingStopTrail, *cmdTrailingStopPrice, *cmdTrailingStopOffset, *cmdTrailingStopAmount))
+			if err != nil {
+				fatal(err)
+			}
+			render(triggerRecords([]conditionalOrder{trigger}), func() {
+				printTriggers([]conditionalOrder{trigger})
+			})
 		}
-	case "cancel":
+	case "oco":
+		newOco(ctx, exchange, *appExchange, *cmdOcoPair, *cmdOcoSide, *cmdOcoTake, *cmdOcoStop, *cmdOcoOffset, *cmdOcoAmount,
+			orderSafeguards{DryRun: *cmdOcoDryRun, Yes: *cmdOcoYes})
+	case "twap":
+		runTwap(ctx, exchange, twapPlan{
+			Pair:     *cmdTwapPair,
+			Side:     *cmdTwapSide,
+			Total:    *cmdTwapAmount,
+			Limit:    *cmdTwapLimit,
+			Duration: *cmdTwapDuration,
+			Slices:   *cmdTwapSlices,
+			Visible:  *cmdTwapVisible,
+		}, orderSafeguards{DryRun: *cmdTwapDryRun, Yes: *cmdTwapYes})
+	case "daemon":
 		{
-			channel := make(chan yobit.CancelOrderResponse)
-			go yobt.CancelOrder(*cmdCancelOrderOrderId, channel)
-			cancelResult := <-channel
-			fmt.Printf("Order %d candeled\n", cancelResult.Result.OrderId)
+			if *cmdDaemonInterval <= 0 {
+				fatal("daemon interval must be positive")
+			}
+			interval := watchInterval(*cmdDaemonInterval, yob2.PollInterval, btrx.PollInterval)
+			if err := runDaemon(ctx, exchanges, interval); err != nil {
+				fatal(err)
+			}
 		}
 	default:
 		fatal("Unknown command " + command)
 	}
 
 }
+
+// walletsReport is every balance source of the wallets command
+type walletsReport struct {
+	Coins    map[string]coinmarketcap.Coin
+	Balances []wr.Balance
+	Errors   []error
+}
+
+// fetchWallets queries exchanges, cold wallets and CoinMarketCap concurrently.
+// Succeeded sources go to Balances, failed ones to Errors.
+func fetchWallets(ctx context.Context, credential GlobalCredentials, exchanges []wr.Exchange, byAddress bool) walletsReport {
+	cmc := wr.CoinMarketCap{}
+	balancesChannel := make(chan wr.BalanceResponse, len(exchanges))
+	cmcMarketChannel := make(chan wr.MarketDataResponse)
+	etherScanChannel := make(chan wr.EthereumBalancesResponse)
+	blockCypherChannel := make(chan wr.BlockCypherBalancesResponse, len(credential.BlockCypher.Addresses))
+
+	// get EtherScan accounting data
+	go wr.GetEthereumBalances(ctx, credential.Etherscan, etherScanChannel)
+
+	// get BTC, LTC and other cold wallets from Blockcyper.com, one balance per coin
+	for coin, addresses := range credential.BlockCypher.Addresses {
+		go wr.GetBlockCypherBalances(ctx, coin, addresses, blockCypherChannel)
+	}
+
+	// get CoinMarketCup market data
+	go cmc.GetMarketData(ctx, cmcMarketChannel)
+
+	// launch GetBalances
+	for _, exc := range exchanges {
+		go exc.GetBalances(ctx, balancesChannel)
+	}
+
+	var report walletsReport
+	for range exchanges {
+		if rs := <-balancesChannel; rs.Err != nil {
+			report.Errors = append(report.Errors, rs.Err)
+		} else {
+			report.Balances = append(report.Balances, rs.Balance)
+		}
+	}
+	if rs := <-etherScanChannel; rs.Err != nil {
+		report.Errors = append(report.Errors, rs.Err)
+	} else {
+		report.Balances = append(report.Balances, rs.Balances.SummaryBalance())
+		if byAddress {
+			report.Balances = append(report.Balances, rs.Balances.AddressBalances(credential.Etherscan.Labels)...)
+		}
+	}
+	for range credential.BlockCypher.Addresses {
+		if rs := <-blockCypherChannel; rs.Err != nil {
+			report.Errors = append(report.Errors, rs.Err)
+		} else {
+			report.Balances = append(report.Balances, rs.Balances.SummaryBalance())
+			if byAddress {
+				report.Balances = append(report.Balances, rs.Balances.AddressBalances(credential.BlockCypher.Labels)...)
+			}
+		}
+	}
+	marketData := <-cmcMarketChannel
+	if marketData.Err != nil {
+		report.Errors = append(report.Errors, marketData.Err)
+	}
+	report.Coins = marketData.Coins
+	sort.Sort(wr.ByExchangeName{Balances: report.Balances})
+	return report
+}
+
+// walletsPollInterval lists rate limits of every wallets source
+func walletsPollInterval(credential GlobalCredentials, exchanges []wr.Exchange) []time.Duration {
+	rs := []time.Duration{wr.CoinMarketCapPollInterval}
+	for _, exc := range exchanges {
+		rs = append(rs, exc.PollInterval)
+	}
+	addresses := 0
+	for _, coinAddresses := range credential.BlockCypher.Addresses {
+		addresses += len(coinAddresses)
+	}
+	return append(rs, wr.BlockCypherPollInterval*time.Duration(addresses))
+}
+
+// commandContext returns context cancelled after timeout or by the first Ctrl-C, zero timeout disables it.
+// The second Ctrl-C terminates the process immediately.
+func commandContext(timeout time.Duration) (context.Context, context.CancelFunc) {
+	var (
+		ctx    context.Context
+		cancel context.CancelFunc
+	)
+	if timeout > 0 {
+		ctx, cancel = context.WithTimeout(context.Background(), timeout)
+	} else {
+		ctx, cancel = context.WithCancel(context.Background())
+	}
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt)
+	go func() {
+		select {
+		case <-interrupt:
+			log.Println("Interrupted, cancelling requests")
+			cancel()
+		case <-ctx.Done():
+		}
+		signal.Stop(interrupt)
+	}()
+	return ctx, cancel
+}
+
+// decimalValue is kingpin.Value keeping exact decimal of a rate or an amount
+type decimalValue decimal.Decimal
+
+func (d *decimalValue) Set(value string) error {
+	parsed, err := decimal.NewFromString(value)
+	if err != nil {
+		return fmt.Errorf("'%s' is not a decimal number", value)
+	}
+	*d = decimalValue(parsed)
+	return nil
+}
+
+func (d *decimalValue) String() string {
+	return decimal.Decimal(*d).String()
+}
+
+func decimalArg(s kingpin.Settings) *decimal.Decimal {
+	target := new(decimal.Decimal)
+	s.SetValue((*decimalValue)(target))
+	return target
+}
+
+// trailValue is kingpin.Value of the trailing stop distance: 0.001 or 5%
+type trailValue trailDistance
+
+func (t *trailValue) Set(value string) error {
+	percent := strings.HasSuffix(value, "%")
+	amount, err := decimal.NewFromString(strings.TrimSuffix(value, "%"))
+	if err != nil || amount.Sign() <= 0 {
+		return fmt.Errorf("'%s' is not a positive amount or percents", value)
+	}
+	*t = trailValue{Amount: amount, Percent: percent}
+	return nil
+}
+
+func (t *trailValue) String() string {
+	if t.Percent {
+		return t.Amount.String() + "%"
+	}
+	return t.Amount.String()
+}
+
+func trailArg(s kingpin.Settings) *trailDistance {
+	target := new(trailDistance)
+	s.SetValue((*trailValue)(target))
+	return target
+}
+
+// pairValue is kingpin.Value accepting the canonical pair syntax only: eth_btc
+type pairValue string
+
+func (p *pairValue) Set(value string) error {
+	pair, err := wr.ParsePair(value)
+	if err != nil {
+		return err
+	}
+	*p = pairValue(pair.String())
+	return nil
+}
+
+func (p *pairValue) String() string {
+	return string(*p)
+}
+
+func pairArg(s kingpin.Settings) *string {
+	target := new(string)
+	s.SetValue((*pairValue)(target))
+	return target
+}
+
+// pairsValue is the repeatable pairValue, a single value may join pairs with dashes: eth_btc-ltc_btc
+type pairsValue []string
+
+func (p *pairsValue) Set(value string) error {
+	for _, v := range strings.Split(value, "-") {
+		var pair pairValue
+		if err := pair.Set(v); err != nil {
+			return err
+		}
+		*p = append(*p, string(pair))
+	}
+	return nil
+}
+
+func (p *pairsValue) String() string {
+	return strings.Join(*p, ",")
+}
+
+func (p *pairsValue) IsCumulative() bool {
+	return true
+}
+
+func pairsArg(s kingpin.Settings) *[]string {
+	target := new([]string)
+	s.SetValue((*pairsValue)(target))
+	return target
+}
@@ -0,0 +1,226 @@
+/*
+ * MIT License
+ *
+ * Copyright (c) 2018 Igor Konovalov
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+	wr "github.com/ikonovalov/global-trade/wrappers"
+	"github.com/shopspring/decimal"
+)
+
+// newOco places the take limit order and stores the stop watching the last price. The stop
+// order is placed offset percents worse than the stop price when it fires.
+func newOco(ctx context.Context, exchange wr.Exchange, exchangeName string, pair string, side string,
+	take decimal.Decimal, stop decimal.Decimal, offset decimal.Decimal, amount decimal.Decimal, safeguards orderSafeguards) {
+	o := conditionalOrder{
+		Kind:      triggerOco,
+		Exchange:  exchangeName,
+		Pair:      pair,
+		Side:      side,
+		Source:    priceLast,
+		Trigger:   stop,
+		Direction: triggerDirection(triggerStop, side),
+		Take:      take,
+		Offset:    offset,
+		Amount:    amount,
+	}
+	if stop.Sign() <= 0 {
+		fatal(fmt.Errorf("stop %s is not positive", stop))
+	}
+
+	checkCtx, cancel := pollContext(ctx)
+	preview, market, err := previewOrder(checkCtx, exchange, pair, side, take, amount)
+	cancel()
+	if err != nil {
+		fatal(err)
+	}
+	// funds of the stop leg are known only after the take order is cancelled, the exchange checks them
+	o.Precision = market.Precision
+	o.Rate = o.limitRate(stop)
+	if err := wr.ValidateOrder(exchange.Name, market, nil, side, o.Rate, amount); err != nil {
+		fatal(err)
+	}
+	if preview.Last.Sign() <= 0 {
+		fatal(fmt.Errorf("last price of %s is unknown", strings.ToUpper(pair)))
+	}
+	if side == wr.SideSell && (take.LessThanOrEqual(preview.Last) || stop.GreaterThanOrEqual(preview.Last)) ||
+		side == wr.SideBuy && (take.GreaterThanOrEqual(preview.Last) || stop.LessThanOrEqual(preview.Last)) {
+		fatal(fmt.Errorf("last price %s must be between the take %s and the stop %s", preview.Last, take, stop))
+	}
+
+	if safeguards.DryRun {
+		render(orderPreviewRecords([]orderPreview{preview}), func() {
+			printOrderPreview(preview)
+			printOcoStop(o)
+			fmt.Fprintln(stdout, "Dry run, the order is not placed")
+		})
+		return
+	}
+	if !safeguards.Yes {
+		printTo(os.Stderr, func() {
+			printOrderPreview(preview)
+			printOcoStop(o)
+		})
+		if ok, err := confirm("Place the order?"); err != nil {
+			fatal(err)
+		} else if !ok {
+			fatal("Order is not placed")
+		}
+	}
+
+	placeCtx, cancel := pollContext(ctx)
+	channel := make(chan wr.PlaceOrderResponse, 1)
+	go exchange.PlaceOrder(placeCtx, pair, side, take, amount, channel)
+	rs := <-channel
+	cancel()
+	if rs.Err != nil {
+		fatal(rs.Err)
+	}
+
+	o.TakeOrderId = rs.Result.OrderId
+	o.Amount = rs.Result.Remains
+	o.Filled = amount.Sub(rs.Result.Remains)
+	o.Created = time.Now().Unix()
+	o.Status = triggerPending
+	if o.Amount.Sign() <= 0 {
+		o.Status = triggerFilled
+	}
+	if err := saveTrigger(&o); err != nil {
+		fatal(fmt.Errorf("take order %s is placed, but the stop is not stored: %s", o.TakeOrderId, err))
+	}
+	render(triggerRecords([]conditionalOrder{o}), func() {
+		printTriggers([]conditionalOrder{o})
+	})
+}
+
+// openOcoOrders returns open orders of OCO trigger pairs by order id
+func openOcoOrders(ctx context.Context, exchange wr.Exchange, triggers []conditionalOrder) (map[string]wr.Order, error) {
+	rs := make(map[string]wr.Order)
+	seen := make(map[string]bool)
+	for _, o := range triggers {
+		if o.Kind != triggerOco || seen[o.Pair] {
+			continue
+		}
+		seen[o.Pair] = true
+		pollCtx, cancel := pollContext(ctx)
+		channel := make(chan wr.OrdersResponse, 1)
+		go exchange.OpenOrders(pollCtx, o.Pair, channel)
+		orders := <-channel
+		cancel()
+		if orders.Err != nil {
+			return nil, orders.Err
+		}
+		for _, order := range orders.Orders {
+			rs[order.Id] = order
+		}
+	}
+	return rs, nil
+}
+
+// orderInfo fetches the order, --timeout applies to the call
+func orderInfo(ctx context.Context, exchange wr.Exchange, orderId string) (wr.Order, error) {
+	ctx, cancel := pollContext(ctx)
+	defer cancel()
+	channel := make(chan wr.OrderInfoResponse, 1)
+	go exchange.OrderInfo(ctx, orderId, channel)
+	rs := <-channel
+	return rs.Order, rs.Err
+}
+
+// trackOco resizes the stop by partial fills of the take order and completes the OCO once the
+// take order is closed. done reports the OCO doesn't wait for the stop anymore.
+func trackOco(ctx context.Context, exchange wr.Exchange, o conditionalOrder, open map[string]wr.Order) (rs conditionalOrder, done bool, err error) {
+	take, ok := open[o.TakeOrderId]
+	if !ok {
+		// closed orders are not listed, ask for the outcome
+		if take, err = orderInfo(ctx, exchange, o.TakeOrderId); err != nil {
+			return o, false, err
+		}
+	}
+
+	event := eventResized
+	switch {
+	case take.Status == wr.OrderFilled:
+		event = triggerFilled
+	case take.Status != wr.OrderActive:
+		event = triggerCancelled
+	case take.Amount.GreaterThanOrEqual(o.Amount):
+		return o, false, nil
+	}
+	rs, err = updateTrigger(o.Id, event, decimal.Zero, func(o *conditionalOrder) error {
+		if o.Status != triggerPending {
+			return errTriggerNotPending
+		}
+		remains := take.Amount
+		if event == triggerFilled {
+			remains = decimal.Zero
+		}
+		o.Filled = o.Filled.Add(o.Amount).Sub(remains)
+		o.Amount = remains
+		switch event {
+		case triggerFilled:
+			o.Status = triggerFilled
+		case triggerCancelled:
+			o.Status = triggerCancelled
+			o.Error = fmt.Sprintf("take order %s is %s on the exchange, the stop is dropped", o.TakeOrderId, take.Status)
+		}
+		return nil
+	})
+	if err == errTriggerNotPending {
+		return o, true, nil
+	}
+	if err != nil {
+		return o, false, err
+	}
+	printTriggerEvent(rs, event, decimal.Zero)
+	return rs, event != eventResized, nil
+}
+
+// cancelTakeOrder cancels the take order of the fired OCO and returns its unfilled amount
+func cancelTakeOrder(ctx context.Context, exchange wr.Exchange, o conditionalOrder) (decimal.Decimal, error) {
+	_, cancelErr := submitCancel(ctx, exchange, o.TakeOrderId)
+	// the order may be filled meanwhile, its state decides
+	take, err := orderInfo(ctx, exchange, o.TakeOrderId)
+	if err != nil {
+		if cancelErr != nil {
+			return decimal.Zero, cancelErr
+		}
+		return decimal.Zero, err
+	}
+	switch take.Status {
+	case wr.OrderFilled:
+		return decimal.Zero, nil
+	case wr.OrderActive:
+		if cancelErr == nil {
+			cancelErr = fmt.Errorf("take order %s is still active", o.TakeOrderId)
+		}
+		return decimal.Zero, cancelErr
+	}
+	return take.Amount, nil
+}
@@ -0,0 +1,681 @@
+/*
+ * MIT License
+ *
+ * Copyright (c) 2018 Igor Konovalov
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+	w "github.com/ikonovalov/global-trade/wrappers"
+	"github.com/miguelmota/go-coinmarketcap"
+	"github.com/shopspring/decimal"
+	"golang.org/x/crypto/ssh/terminal"
+	"gopkg.in/yaml.v2"
+)
+
+const (
+	outputTable = "table"
+	outputJson  = "json"
+	outputCsv   = "csv"
+	outputYaml  = "yaml"
+)
+
+var (
+	// stdout is the destination of all printers. ANSI colors are stripped when it is not a terminal.
+	stdout io.Writer = os.Stdout
+
+	ansiEscape = regexp.MustCompile("\x1b\\[[0-9;]*m")
+)
+
+// Output records. Every command emits a list of flat records, field names are the stable schema
+// shared by json, yaml and csv (header) formats. Decimals are serialized as strings.
+type (
+	marketRecord struct {
+		Market    string          `json:"market" yaml:"market"`
+		Symbol    string          `json:"symbol" yaml:"symbol"`
+		Hidden    bool            `json:"hidden" yaml:"hidden"`
+		Precision int32           `json:"precision" yaml:"precision"`
+		Fee       decimal.Decimal `json:"fee" yaml:"fee"`
+		MinAmount decimal.Decimal `json:"min_amount" yaml:"min_amount"`
+		MinPrice  decimal.Decimal `json:"min_price" yaml:"min_price"`
+		MaxPrice  decimal.Decimal `json:"max_price" yaml:"max_price"`
+	}
+
+	tickerRecord struct {
+		Pair    string          `json:"pair" yaml:"pair"`
+		High    decimal.Decimal `json:"high" yaml:"high"`
+		Low     decimal.Decimal `json:"low" yaml:"low"`
+		Avg     decimal.Decimal `json:"avg" yaml:"avg"`
+		PrevDay decimal.Decimal `json:"prev_day" yaml:"prev_day"`
+		Last    decimal.Decimal `json:"last" yaml:"last"`
+		Buy     decimal.Decimal `json:"buy" yaml:"buy"`
+		Sell    decimal.Decimal `json:"sell" yaml:"sell"`
+		Vol     decimal.Decimal `json:"vol" yaml:"vol"`
+		VolCur  decimal.Decimal `json:"vol_cur" yaml:"vol_cur"`
+		Updated int64           `json:"updated" yaml:"updated"`
+	}
+
+	offerRecord struct {
+		Pair               string          `json:"pair" yaml:"pair"`
+		Side               string          `json:"side" yaml:"side"`
+		Level              int             `json:"level" yaml:"level"`
+		Price              decimal.Decimal `json:"price" yaml:"price"`
+		Quantity           decimal.Decimal `json:"quantity" yaml:"quantity"`
+		Notional           decimal.Decimal `json:"notional" yaml:"notional"`
+		CumulativeQuantity decimal.Decimal `json:"cumulative_quantity" yaml:"cumulative_quantity"`
+		CumulativeNotional decimal.Decimal `json:"cumulative_notional" yaml:"cumulative_notional"`
+		ZScore             float64         `json:"z_score" yaml:"z_score"`
+		Wall               bool            `json:"wall" yaml:"wall"`
+	}
+
+	tradeRecord struct {
+		Pair      string          `json:"pair" yaml:"pair"`
+		Id        string          `json:"id" yaml:"id"`
+		Side      string          `json:"side" yaml:"side"`
+		Price     decimal.Decimal `json:"price" yaml:"price"`
+		Amount    decimal.Decimal `json:"amount" yaml:"amount"`
+		Timestamp int64           `json:"timestamp" yaml:"timestamp"`
+	}
+
+	walletRecord struct {
+		Exchange         string          `json:"exchange" yaml:"exchange"`
+		Cold             bool            `json:"cold" yaml:"cold"`
+		Address          string          `json:"address" yaml:"address"`
+		Label            string          `json:"label" yaml:"label"`
+		Coin             string          `json:"coin" yaml:"coin"`
+		Hold             decimal.Decimal `json:"hold" yaml:"hold"`
+		Available        decimal.Decimal `json:"available" yaml:"available"`
+		OnOrder          decimal.Decimal `json:"on_order" yaml:"on_order"`
+		PriceUsd         decimal.Decimal `json:"price_usd" yaml:"price_usd"`
+		PriceBtc         decimal.Decimal `json:"price_btc" yaml:"price_btc"`
+		PercentChange1h  decimal.Decimal `json:"percent_change_1h" yaml:"percent_change_1h"`
+		PercentChange24h decimal.Decimal `json:"percent_change_24h" yaml:"percent_change_24h"`
+		PercentChange7d  decimal.Decimal `json:"percent_change_7d" yaml:"percent_change_7d"`
+		VolumeUsd        decimal.Decimal `json:"volume_usd" yaml:"volume_usd"`
+		VolumeBtc        decimal.Decimal `json:"volume_btc" yaml:"volume_btc"`
+		AverageCostUsd   decimal.Decimal `json:"average_cost_usd" yaml:"average_cost_usd"`
+		UnrealizedUsd    decimal.Decimal `json:"unrealized_usd" yaml:"unrealized_usd"`
+	}
+
+	orderRecord struct {
+		Id          string          `json:"id" yaml:"id"`
+		Pair        string          `json:"pair" yaml:"pair"`
+		Side        string          `json:"side" yaml:"side"`
+		Rate        decimal.Decimal `json:"rate" yaml:"rate"`
+		StartAmount decimal.Decimal `json:"start_amount" yaml:"start_amount"`
+		Amount      decimal.Decimal `json:"amount" yaml:"amount"`
+		Status      string          `json:"status" yaml:"status"`
+		Created     int64           `json:"created" yaml:"created"`
+	}
+
+	fillRecord struct {
+		Id        string          `json:"id" yaml:"id"`
+		OrderId   string          `json:"order_id" yaml:"order_id"`
+		Pair      string          `json:"pair" yaml:"pair"`
+		Side      string          `json:"side" yaml:"side"`
+		Rate      decimal.Decimal `json:"rate" yaml:"rate"`
+		Amount    decimal.Decimal `json:"amount" yaml:"amount"`
+		Fee       decimal.Decimal `json:"fee" yaml:"fee"`
+		Timestamp int64           `json:"timestamp" yaml:"timestamp"`
+	}
+
+	orderResultRecord struct {
+		OrderId  string          `json:"order_id" yaml:"order_id"`
+		Received decimal.Decimal `json:"received" yaml:"received"`
+		Remains  decimal.Decimal `json:"remains" yaml:"remains"`
+	}
+
+	orderPreviewRecord struct {
+		Exchange   string          `json:"exchange" yaml:"exchange"`
+		Pair       string          `json:"pair" yaml:"pair"`
+		Side       string          `json:"side" yaml:"side"`
+		Rate       decimal.Decimal `json:"rate" yaml:"rate"`
+		Amount     decimal.Decimal `json:"amount" yaml:"amount"`
+		Total      decimal.Decimal `json:"total" yaml:"total"`
+		FeePercent decimal.Decimal `json:"fee_percent" yaml:"fee_percent"`
+		Fee        decimal.Decimal `json:"fee" yaml:"fee"`
+		Last       decimal.Decimal `json:"last" yaml:"last"`
+		Deviation  decimal.Decimal `json:"deviation" yaml:"deviation"`
+	}
+
+	cancelRecord struct {
+		OrderId string `json:"order_id" yaml:"order_id"`
+	}
+
+	pnlRecord struct {
+		Coin        string          `json:"coin" yaml:"coin"`
+		Method      string          `json:"method" yaml:"method"`
+		Amount      decimal.Decimal `json:"amount" yaml:"amount"`
+		AverageCost decimal.Decimal `json:"average_cost" yaml:"average_cost"`
+		CostBasis   decimal.Decimal `json:"cost_basis" yaml:"cost_basis"`
+		Price       decimal.Decimal `json:"price" yaml:"price"`
+		MarketValue decimal.Decimal `json:"market_value" yaml:"market_value"`
+		Unrealized  decimal.Decimal `json:"unrealized" yaml:"unrealized"`
+		Realized    decimal.Decimal `json:"realized" yaml:"realized"`
+		Unmatched   decimal.Decimal `json:"unmatched" yaml:"unmatched"`
+		Unvalued    bool            `json:"unvalued" yaml:"unvalued"`
+	}
+
+	taxLotRecord struct {
+		Coin         string          `json:"coin" yaml:"coin"`
+		Amount       decimal.Decimal `json:"amount" yaml:"amount"`
+		DateAcquired string          `json:"date_acquired" yaml:"date_acquired"`
+		DateSold     string          `json:"date_sold" yaml:"date_sold"`
+		Proceeds     decimal.Decimal `json:"proceeds" yaml:"proceeds"`
+		Cost         decimal.Decimal `json:"cost" yaml:"cost"`
+		Gain         decimal.Decimal `json:"gain" yaml:"gain"`
+		Term         string          `json:"term" yaml:"term"`
+	}
+
+	arbRecord struct {
+		Pair             string          `json:"pair" yaml:"pair"`
+		BuyExchange      string          `json:"buy_exchange" yaml:"buy_exchange"`
+		BuyPrice         decimal.Decimal `json:"buy_price" yaml:"buy_price"`
+		BuyFee           decimal.Decimal `json:"buy_fee" yaml:"buy_fee"`
+		SellExchange     string          `json:"sell_exchange" yaml:"sell_exchange"`
+		SellPrice        decimal.Decimal `json:"sell_price" yaml:"sell_price"`
+		SellFee          decimal.Decimal `json:"sell_fee" yaml:"sell_fee"`
+		NetSpread        decimal.Decimal `json:"net_spread" yaml:"net_spread"`
+		TopAmount        decimal.Decimal `json:"top_amount" yaml:"top_amount"`
+		ExecutableAmount decimal.Decimal `json:"executable_amount" yaml:"executable_amount"`
+		Profit           decimal.Decimal `json:"profit" yaml:"profit"`
+		FundsKnown       bool            `json:"funds_known" yaml:"funds_known"`
+	}
+
+	snapshotRecord struct {
+		Id       uint64          `json:"id" yaml:"id"`
+		Taken    int64           `json:"taken" yaml:"taken"`
+		Holdings int             `json:"holdings" yaml:"holdings"`
+		ValueUsd decimal.Decimal `json:"value_usd" yaml:"value_usd"`
+		ValueBtc decimal.Decimal `json:"value_btc" yaml:"value_btc"`
+		Failed   string          `json:"failed" yaml:"failed"`
+	}
+
+	triggerRecord struct {
+		Id          uint64          `json:"id" yaml:"id"`
+		Kind        string          `json:"kind" yaml:"kind"`
+		Exchange    string          `json:"exchange" yaml:"exchange"`
+		Pair        string          `json:"pair" yaml:"pair"`
+		Side        string          `json:"side" yaml:"side"`
+		Source      string          `json:"source" yaml:"source"`
+		Trigger     decimal.Decimal `json:"trigger" yaml:"trigger"`
+		Direction   string          `json:"direction" yaml:"direction"`
+		Trail       string          `json:"trail" yaml:"trail"`
+		Extreme     decimal.Decimal `json:"extreme" yaml:"extreme"`
+		Offset      decimal.Decimal `json:"offset" yaml:"offset"`
+		Take        decimal.Decimal `json:"take" yaml:"take"`
+		TakeOrderId string          `json:"take_order_id" yaml:"take_order_id"`
+		Filled      decimal.Decimal `json:"filled" yaml:"filled"`
+		Rate        decimal.Decimal `json:"rate" yaml:"rate"`
+		Amount      decimal.Decimal `json:"amount" yaml:"amount"`
+		Created     int64           `json:"created" yaml:"created"`
+		Status      string          `json:"status" yaml:"status"`
+		Updated     int64           `json:"updated" yaml:"updated"`
+		OrderId     string          `json:"order_id" yaml:"order_id"`
+		Error       string          `json:"error" yaml:"error"`
+	}
+
+	triggerEventRecord struct {
+		Id      uint64          `json:"id" yaml:"id"`
+		Trigger uint64          `json:"trigger" yaml:"trigger"`
+		Time    int64           `json:"time" yaml:"time"`
+		Event   string          `json:"event" yaml:"event"`
+		Price   decimal.Decimal `json:"price" yaml:"price"`
+		Level   decimal.Decimal `json:"level" yaml:"level"`
+		Extreme decimal.Decimal `json:"extreme" yaml:"extreme"`
+		Message string          `json:"message" yaml:"message"`
+	}
+
+	twapRecord struct {
+		Exchange     string          `json:"exchange" yaml:"exchange"`
+		Pair         string          `json:"pair" yaml:"pair"`
+		Side         string          `json:"side" yaml:"side"`
+		Total        decimal.Decimal `json:"total" yaml:"total"`
+		Filled       decimal.Decimal `json:"filled" yaml:"filled"`
+		Unfilled     decimal.Decimal `json:"unfilled" yaml:"unfilled"`
+		AveragePrice decimal.Decimal `json:"average_price" yaml:"average_price"`
+		ArrivalPrice decimal.Decimal `json:"arrival_price" yaml:"arrival_price"`
+		Slippage     decimal.Decimal `json:"slippage" yaml:"slippage"`
+		Children     int             `json:"children" yaml:"children"`
+		Started      int64           `json:"started" yaml:"started"`
+		Finished     int64           `json:"finished" yaml:"finished"`
+		Interrupted  bool            `json:"interrupted" yaml:"interrupted"`
+	}
+
+	snapshotDiffRecord struct {
+		Exchange       string          `json:"exchange" yaml:"exchange"`
+		Coin           string          `json:"coin" yaml:"coin"`
+		HoldFrom       decimal.Decimal `json:"hold_from" yaml:"hold_from"`
+		HoldTo         decimal.Decimal `json:"hold_to" yaml:"hold_to"`
+		HoldChange     decimal.Decimal `json:"hold_change" yaml:"hold_change"`
+		ValueUsdFrom   decimal.Decimal `json:"value_usd_from" yaml:"value_usd_from"`
+		ValueUsdTo     decimal.Decimal `json:"value_usd_to" yaml:"value_usd_to"`
+		ValueUsdChange decimal.Decimal `json:"value_usd_change" yaml:"value_usd_change"`
+		ValueBtcFrom   decimal.Decimal `json:"value_btc_from" yaml:"value_btc_from"`
+		ValueBtcTo     decimal.Decimal `json:"value_btc_to" yaml:"value_btc_to"`
+		ValueBtcChange decimal.Decimal `json:"value_btc_change" yaml:"value_btc_change"`
+	}
+)
+
+// plainWriter strips ANSI colors
+type plainWriter struct {
+	io.Writer
+}
+
+func (pw plainWriter) Write(p []byte) (int, error) {
+	if _, err := pw.Writer.Write(ansiEscape.ReplaceAll(p, nil)); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func setupOutput() {
+	if *appOutput != outputTable || !terminal.IsTerminal(int(os.Stdout.Fd())) {
+		stdout = plainWriter{os.Stdout}
+	}
+}
+
+// render prints records in the machine-readable format chosen by --output or calls table printer.
+func render(records interface{}, table func()) {
+	var err error
+	switch *appOutput {
+	case outputJson:
+		encoder := json.NewEncoder(stdout)
+		encoder.SetIndent("", "  ")
+		err = encoder.Encode(records)
+	case outputYaml:
+		var data []byte
+		if data, err = yaml.Marshal(records); err == nil {
+			_, err = stdout.Write(data)
+		}
+	case outputCsv:
+		err = writeCsv(stdout, records)
+	default:
+		table()
+	}
+	if err != nil {
+		fatal(err)
+	}
+}
+
+// writeCsv writes slice of flat records, header is made of json field names.
+func writeCsv(out io.Writer, records interface{}) error {
+	slice := reflect.ValueOf(records)
+	recordType := slice.Type().Elem()
+	writer := csv.NewWriter(out)
+
+	header := make([]string, recordType.NumField())
+	for i := range header {
+		header[i] = strings.Split(recordType.Field(i).Tag.Get("json"), ",")[0]
+	}
+	if err := writer.Write(header); err != nil {
+		return err
+	}
+	for i := 0; i < slice.Len(); i++ {
+		record := slice.Index(i)
+		row := make([]string, record.NumField())
+		for j := range row {
+			row[j] = fmt.Sprint(record.Field(j).Interface())
+		}
+		if err := writer.Write(row); err != nil {
+			return err
+		}
+	}
+	writer.Flush()
+	return writer.Error()
+}
+
+func marketRecords(markets []w.Market, currencyFilter string) []marketRecord {
+	rs := make([]marketRecord, 0, len(markets))
+	for _, m := range markets {
+		if !marketHasCurrency(m, currencyFilter) {
+			continue
+		}
+		rs = append(rs, marketRecord{
+			Market:    m.Pair.String(),
+			Symbol:    m.Symbol,
+			Hidden:    m.Hidden,
+			Precision: m.Precision,
+			Fee:       m.Fee,
+			MinAmount: m.MinAmount,
+			MinPrice:  m.MinPrice,
+			MaxPrice:  m.MaxPrice,
+		})
+	}
+	sort.Slice(rs, func(i, j int) bool { return rs[i].Market < rs[j].Market })
+	return rs
+}
+
+// marketHasCurrency is true for the market trading currency as base or quote, any market matches empty currency
+func marketHasCurrency(m w.Market, currency string) bool {
+	if currency == "" {
+		return true
+	}
+	currency = w.NewPair(currency, "").Base
+	return m.Pair.Base == currency || m.Pair.Quote == currency
+}
+
+func tickerRecords(tickers map[string]w.Ticker) []tickerRecord {
+	rs := make([]tickerRecord, 0, len(tickers))
+	for pair, t := range tickers {
+		rs = append(rs, tickerRecord{
+			Pair:    pair,
+			High:    t.High,
+			Low:     t.Low,
+			Avg:     t.Avg,
+			PrevDay: t.PrevDay,
+			Last:    t.Last,
+			Buy:     t.Buy,
+			Sell:    t.Sell,
+			Vol:     t.Vol,
+			VolCur:  t.VolCur,
+			Updated: t.Updated,
+		})
+	}
+	sort.Slice(rs, func(i, j int) bool { return rs[i].Pair < rs[j].Pair })
+	return rs
+}
+
+func offerRecords(book w.OrderBook, settings wallSettings) []offerRecord {
+	rs := make([]offerRecord, 0, len(book.Asks)+len(book.Bids))
+	appendSide := func(side string, levels []w.OrderBookLevel) {
+		for i, l := range analyzeDepth(levels, settings) {
+			rs = append(rs, offerRecord{
+				Pair:               book.Pair,
+				Side:               side,
+				Level:              i + 1,
+				Price:              l.Price,
+				Quantity:           l.Quantity,
+				Notional:           l.Notional,
+				CumulativeQuantity: l.CumulativeQuantity,
+				CumulativeNotional: l.CumulativeNotional,
+				ZScore:             math.Round(l.ZScore*100) / 100,
+				Wall:               l.Wall,
+			})
+		}
+	}
+	appendSide("ask", book.Asks)
+	appendSide("bid", book.Bids)
+	return rs
+}
+
+func tradeRecords(trades []w.Trade) []tradeRecord {
+	rs := make([]tradeRecord, 0, len(trades))
+	for _, t := range trades {
+		rs = append(rs, tradeRecord{
+			Pair:      t.Pair,
+			Id:        t.Id,
+			Side:      t.Side,
+			Price:     t.Price,
+			Amount:    t.Amount,
+			Timestamp: t.Timestamp,
+		})
+	}
+	return rs
+}
+
+// walletRecords flattens balances. costsUsd is the average cost of coins known to the ledger,
+// unrealized PnL is zero for the others.
+func walletRecords(coinsMarket map[string]coinmarketcap.Coin, balances []w.Balance, costsUsd map[string]decimal.Decimal, hideZeros bool) []walletRecord {
+	rs := make([]walletRecord, 0)
+	for _, balance := range balances {
+		coins := make([]string, 0, len(balance.Funds))
+		for c := range balance.Funds {
+			coins = append(coins, c)
+		}
+		sort.Strings(coins)
+
+		for _, coin := range coins {
+			volume := balance.Funds[coin]
+			if hideZeros && volume.IsZero() {
+				continue
+			}
+			coinUpperCase := strings.ToUpper(coin)
+			coinData := coinsMarket[coinUpperCase]
+			priceUsd := decimal.NewFromFloat(coinData.PriceUsd)
+			priceBtc := decimal.NewFromFloat(coinData.PriceBtc)
+			var unrealizedUsd decimal.Decimal
+			costUsd, hasCost := costsUsd[coinUpperCase]
+			if hasCost {
+				unrealizedUsd = volume.Mul(priceUsd.Sub(costUsd))
+			}
+			rs = append(rs, walletRecord{
+				Exchange:         balance.Exchange.Name,
+				Cold:             balance.Exchange.Cold,
+				Address:          balance.Address,
+				Label:            balance.Label,
+				Coin:             coinUpperCase,
+				Hold:             volume,
+				Available:        balance.AvailableFunds[coin],
+				OnOrder:          volume.Sub(balance.AvailableFunds[coin]),
+				PriceUsd:         priceUsd,
+				PriceBtc:         priceBtc,
+				PercentChange1h:  decimal.NewFromFloat(coinData.PercentChange1h),
+				PercentChange24h: decimal.NewFromFloat(coinData.PercentChange24h),
+				PercentChange7d:  decimal.NewFromFloat(coinData.PercentChange7d),
+				VolumeUsd:        volume.Mul(priceUsd),
+				VolumeBtc:        volume.Mul(priceBtc),
+				AverageCostUsd:   costUsd,
+				UnrealizedUsd:    unrealizedUsd,
+			})
+		}
+	}
+	return rs
+}
+
+func orderRecords(orders []w.Order) []orderRecord {
+	rs := make([]orderRecord, 0, len(orders))
+	for _, o := range orders {
+		rs = append(rs, orderRecord{
+			Id:          o.Id,
+			Pair:        o.Pair,
+			Side:        o.Side,
+			Rate:        o.Rate,
+			StartAmount: o.StartAmount,
+			Amount:      o.Amount,
+			Status:      o.Status.String(),
+			Created:     o.Created,
+		})
+	}
+	sort.SliceStable(rs, func(i, j int) bool { return rs[i].Created < rs[j].Created })
+	return rs
+}
+
+func fillRecords(fills []w.Fill) []fillRecord {
+	rs := make([]fillRecord, 0, len(fills))
+	for _, f := range fills {
+		rs = append(rs, fillRecord{
+			Id:        f.Id,
+			OrderId:   f.OrderId,
+			Pair:      f.Pair,
+			Side:      f.Side,
+			Rate:      f.Rate,
+			Amount:    f.Amount,
+			Fee:       f.Fee,
+			Timestamp: f.Timestamp,
+		})
+	}
+	sort.SliceStable(rs, func(i, j int) bool { return rs[i].Timestamp < rs[j].Timestamp })
+	return rs
+}
+
+func snapshotRecords(snapshots []portfolioSnapshot) []snapshotRecord {
+	rs := make([]snapshotRecord, 0, len(snapshots))
+	for _, s := range snapshots {
+		rs = append(rs, snapshotRecord{
+			Id:       s.Id,
+			Taken:    s.Taken,
+			Holdings: len(s.Holdings),
+			ValueUsd: s.valueUsd(),
+			ValueBtc: s.valueBtc(),
+			Failed:   strings.Join(s.Failed, "; "),
+		})
+	}
+	return rs
+}
+
+func triggerRecords(triggers []conditionalOrder) []triggerRecord {
+	rs := make([]triggerRecord, 0, len(triggers))
+	for _, o := range triggers {
+		record := triggerRecord{
+			Id:          o.Id,
+			Kind:        o.Kind,
+			Exchange:    o.Exchange,
+			Pair:        o.Pair,
+			Side:        o.Side,
+			Source:      o.Source,
+			Trigger:     o.Trigger,
+			Direction:   o.Direction,
+			Extreme:     o.Extreme,
+			Offset:      o.Offset,
+			Take:        o.Take,
+			TakeOrderId: o.TakeOrderId,
+			Filled:      o.Filled,
+			Rate:        o.Rate,
+			Amount:      o.Amount,
+			Created:     o.Created,
+			Status:      o.Status,
+			Updated:     o.Updated,
+			OrderId:     o.OrderId,
+			Error:       o.Error,
+		}
+		if o.Kind == triggerTrailingStop {
+			record.Trail = o.Trail.String()
+			if o.TrailPercent {
+				record.Trail += "%"
+			}
+		}
+		rs = append(rs, record)
+	}
+	return rs
+}
+
+func triggerEventRecords(events []triggerEvent) []triggerEventRecord {
+	rs := make([]triggerEventRecord, 0, len(events))
+	for _, e := range events {
+		rs = append(rs, triggerEventRecord(e))
+	}
+	return rs
+}
+
+func twapRecords(reports []twapReport) []twapRecord {
+	rs := make([]twapRecord, 0, len(reports))
+	for _, r := range reports {
+		rs = append(rs, twapRecord{
+			Exchange:     r.Exchange,
+			Pair:         r.Pair,
+			Side:         r.Side,
+			Total:        r.Total,
+			Filled:       r.Filled,
+			Unfilled:     r.Total.Sub(r.Filled),
+			AveragePrice: r.AveragePrice,
+			ArrivalPrice: r.ArrivalPrice,
+			Slippage:     r.Slippage,
+			Children:     len(r.Children),
+			Started:      r.Started,
+			Finished:     r.Finished,
+			Interrupted:  r.Interrupted,
+		})
+	}
+	return rs
+}
+
+func pnlRecords(positions []*position, coinsMarket map[string]coinmarketcap.Coin, method string) []pnlRecord {
+	rs := make([]pnlRecord, 0, len(positions))
+	for _, p := range positions {
+		record := pnlRecord{
+			Coin:        p.Coin,
+			Method:      method,
+			Amount:      p.Amount(),
+			AverageCost: p.AverageCost(),
+			CostBasis:   p.CostBasis(),
+			Realized:    p.Realized,
+			Unmatched:   p.Unmatched,
+			Unvalued:    p.Unvalued,
+		}
+		if price, ok := usdPrice(coinsMarket, p.Coin); ok {
+			record.Price = price
+			record.MarketValue = record.Amount.Mul(price)
+			record.Unrealized = record.MarketValue.Sub(record.CostBasis)
+		}
+		rs = append(rs, record)
+	}
+	return rs
+}
+
+func arbRecords(opportunities []*arbOpportunity) []arbRecord {
+	rs := make([]arbRecord, 0, len(opportunities))
+	for _, o := range opportunities {
+		rs = append(rs, arbRecord{
+			Pair:             o.Pair.String(),
+			BuyExchange:      o.Buy.Exchange.Name,
+			BuyPrice:         o.BuyPrice,
+			BuyFee:           o.buyFee(),
+			SellExchange:     o.Sell.Exchange.Name,
+			SellPrice:        o.SellPrice,
+			SellFee:          o.sellFee(),
+			NetSpread:        o.NetSpread,
+			TopAmount:        o.TopAmount,
+			ExecutableAmount: o.Executable,
+			Profit:           o.Profit,
+			FundsKnown:       o.Buy.Available != nil && o.Sell.Available != nil,
+		})
+	}
+	return rs
+}
+
+func orderPreviewRecords(previews []orderPreview) []orderPreviewRecord {
+	rs := make([]orderPreviewRecord, 0, len(previews))
+	for _, p := range previews {
+		rs = append(rs, orderPreviewRecord(p))
+	}
+	return rs
+}
+
+func taxLotRecords(disposals []disposal) []taxLotRecord {
+	const dateLayout = "2006-01-02"
+	rs := make([]taxLotRecord, 0, len(disposals))
+	for _, d := range disposals {
+		rs = append(rs, taxLotRecord{
+			Coin:         d.Coin,
+			Amount:       d.Amount,
+			DateAcquired: time.Unix(d.Acquired, 0).Format(dateLayout),
+			DateSold:     time.Unix(d.Disposed, 0).Format(dateLayout),
+			Proceeds:     d.Proceeds,
+			Cost:         d.Cost,
+			Gain:         d.Proceeds.Sub(d.Cost),
+			Term:         d.term(),
+		})
+	}
+	return rs
+}
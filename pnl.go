@@ -0,0 +1,550 @@
+/*
+ * MIT License
+ *
+ * Copyright (c) 2018 Igor Konovalov
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"time"
+	"github.com/miguelmota/go-coinmarketcap"
+	wr "github.com/ikonovalov/global-trade/wrappers"
+	"github.com/shopspring/decimal"
+	bolt "go.etcd.io/bbolt"
+)
+
+const (
+	ledgerFile = "data/ledger.db"
+
+	// fiatCurrency is the valuation currency, its quote leg is not a holding
+	fiatCurrency  = "USD"
+	secondsPerDay = 24 * 60 * 60
+
+	costFifo    = "fifo"
+	costLifo    = "lifo"
+	costAverage = "average"
+)
+
+var fillsBucket = []byte("fills")
+
+type (
+	// ledgerFill is an exchange fill stored in the ledger. QuoteUsd is the USD price of the quote
+	// currency at the fill time, zero until the fill is valued.
+	ledgerFill struct {
+		Exchange string          `json:"exchange"`
+		QuoteUsd decimal.Decimal `json:"quote_usd"`
+		wr.Fill
+	}
+
+	// lot is an acquired amount of a coin not disposed yet. Unvalued lot has no USD cost.
+	lot struct {
+		Amount   decimal.Decimal
+		Rate     decimal.Decimal
+		Acquired int64
+		Unvalued bool
+	}
+
+	// disposal is a sold amount matched against the lot it was acquired with. Unmatched is the part
+	// of a sale exceeding acquisitions known to the ledger, it has neither cost nor acquisition date.
+	// Unvalued disposal misses the USD value of the sale or of the matched lot.
+	disposal struct {
+		Coin      string
+		Amount    decimal.Decimal
+		Proceeds  decimal.Decimal
+		Cost      decimal.Decimal
+		Acquired  int64
+		Disposed  int64
+		Unmatched bool
+		Unvalued  bool
+	}
+
+	// position is the holding of Coin across all exchanges and pairs. Coin spent or received as
+	// the quote currency is booked too. Costs and proceeds are in USD at the fill time, Unvalued
+	// is set when a fill has no USD price yet.
+	position struct {
+		Coin      string
+		Lots      []lot
+		Realized  decimal.Decimal
+		Unmatched decimal.Decimal
+		Unvalued  bool
+		Disposals []disposal
+	}
+
+	importResult struct {
+		Fills []ledgerFill
+		Errs  []error
+	}
+)
+
+func (l ledgerFill) key() []byte {
+	return []byte(l.Exchange + "/" + l.Id)
+}
+
+func (p *position) Amount() decimal.Decimal {
+	amount := decimal.Zero
+	for _, l := range p.Lots {
+		amount = amount.Add(l.Amount)
+	}
+	return amount
+}
+
+func (p *position) CostBasis() decimal.Decimal {
+	cost := decimal.Zero
+	for _, l := range p.Lots {
+		cost = cost.Add(l.Amount.Mul(l.Rate))
+	}
+	return cost
+}
+
+func (p *position) AverageCost() decimal.Decimal {
+	amount := p.Amount()
+	if amount.IsZero() {
+		return decimal.Zero
+	}
+	return p.CostBasis().Div(amount)
+}
+
+// buy adds the lot, average cost method reprices every lot to the pool average keeping their dates,
+// the pool average is unvalued as soon as a single lot is
+func (p *position) buy(amount, rate decimal.Decimal, timestamp int64, method string, unvalued bool) {
+	p.Lots = append(p.Lots, lot{Amount: amount, Rate: rate, Acquired: timestamp, Unvalued: unvalued})
+	if method == costAverage {
+		average := p.AverageCost()
+		for _, l := range p.Lots {
+			unvalued = unvalued || l.Unvalued
+		}
+		for i := range p.Lots {
+			p.Lots[i].Rate = average
+			p.Lots[i].Unvalued = unvalued
+		}
+	}
+}
+
+// sell consumes lots from the head for FIFO and average cost, from the tail for LIFO
+func (p *position) sell(amount, rate decimal.Decimal, timestamp int64, method string, unvalued bool) {
+	for amount.Sign() > 0 && len(p.Lots) > 0 {
+		i := 0
+		if method == costLifo {
+			i = len(p.Lots) - 1
+		}
+		matched := decimal.Min(amount, p.Lots[i].Amount)
+		p.dispose(disposal{Amount: matched, Proceeds: matched.Mul(rate), Cost: matched.Mul(p.Lots[i].Rate),
+			Acquired: p.Lots[i].Acquired, Disposed: timestamp, Unvalued: unvalued || p.Lots[i].Unvalued})
+		p.Lots[i].Amount = p.Lots[i].Amount.Sub(matched)
+		if p.Lots[i].Amount.Sign() == 0 {
+			p.Lots = append(p.Lots[:i], p.Lots[i+1:]...)
+		}
+		amount = amount.Sub(matched)
+	}
+	if amount.Sign() > 0 {
+		p.Unmatched = p.Unmatched.Add(amount)
+		p.dispose(disposal{Amount: amount, Proceeds: amount.Mul(rate), Disposed: timestamp, Unmatched: true, Unvalued: unvalued})
+	}
+}
+
+// dispose records the disposal, unmatched one is left out of realized PnL as its cost is unknown
+func (p *position) dispose(d disposal) {
+	d.Coin = p.Coin
+	if !d.Unmatched {
+		p.Realized = p.Realized.Add(d.Proceeds.Sub(d.Cost))
+	}
+	p.Disposals = append(p.Disposals, d)
+}
+
+// buildPositions replays fills in time order and matches sales against acquisitions
+// with the cost method: fifo, lifo or average. A buy acquires the base coin for the quote amount
+// spent with the fee and disposes of that quote amount, a sale does the opposite with the amount
+// received after the fee.
+func buildPositions(fills []ledgerFill, method string) []*position {
+	sorted := make([]ledgerFill, len(fills))
+	copy(sorted, fills)
+	sort.SliceStable(sorted, func(i, j int) bool { return sorted[i].Timestamp < sorted[j].Timestamp })
+
+	index := make(map[string]*position)
+	rs := make([]*position, 0)
+	positionOf := func(coin string) *position {
+		p, found := index[coin]
+		if !found {
+			p = &position{Coin: coin}
+			index[coin] = p
+			rs = append(rs, p)
+		}
+		return p
+	}
+	for _, f := range sorted {
+		pair, err := wr.ParsePair(f.Pair)
+		if err != nil || f.Amount.Sign() <= 0 {
+			continue
+		}
+		valued := f.QuoteUsd.Sign() > 0
+		base := positionOf(pair.Base)
+		base.Unvalued = base.Unvalued || !valued
+		var quote *position
+		if pair.Quote != fiatCurrency {
+			quote = positionOf(pair.Quote)
+			quote.Unvalued = quote.Unvalued || !valued
+		}
+		total := f.Amount.Mul(f.Rate)
+		if f.Side == wr.SideBuy {
+			spent := total.Add(f.Fee)
+			base.buy(f.Amount, spent.Mul(f.QuoteUsd).Div(f.Amount), f.Timestamp, method, !valued)
+			if quote != nil {
+				quote.sell(spent, f.QuoteUsd, f.Timestamp, method, !valued)
+			}
+		} else {
+			received := total.Sub(f.Fee)
+			base.sell(f.Amount, received.Mul(f.QuoteUsd).Div(f.Amount), f.Timestamp, method, !valued)
+			if quote != nil && received.Sign() > 0 {
+				quote.buy(received, f.QuoteUsd, f.Timestamp, method, !valued)
+			}
+		}
+	}
+	sort.Slice(rs, func(i, j int) bool { return rs[i].Coin < rs[j].Coin })
+	return rs
+}
+
+// usdPrice is the current CoinMarketCap USD price of the currency
+func usdPrice(coinsMarket map[string]coinmarketcap.Coin, currency string) (decimal.Decimal, bool) {
+	if currency == fiatCurrency {
+		return decimal.New(1, 0), true
+	}
+	coin, ok := coinsMarket[currency]
+	if !ok || coin.PriceUsd == 0 {
+		return decimal.Zero, false
+	}
+	return decimal.NewFromFloat(coin.PriceUsd), true
+}
+
+// coinCostsUsd is the average cost in USD of every coin still held by positions
+func coinCostsUsd(positions []*position) map[string]decimal.Decimal {
+	rs := make(map[string]decimal.Decimal)
+	for _, p := range positions {
+		if p.Amount().Sign() > 0 && !p.Unvalued {
+			rs[p.Coin] = p.AverageCost()
+		}
+	}
+	return rs
+}
+
+// loadLedger returns all stored fills, empty ledger if the ledger file does not exist
+func loadLedger() ([]ledgerFill, error) {
+	db, err := openDatabase(ledgerFile, true)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+	rs := make([]ledgerFill, 0)
+	err = db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(fillsBucket)
+		if bucket == nil {
+			return nil
+		}
+		return bucket.ForEach(func(k, v []byte) error {
+			var f ledgerFill
+			if err := json.Unmarshal(v, &f); err != nil {
+				return fmt.Errorf("fill %s: %s", k, err)
+			}
+			rs = append(rs, f)
+			return nil
+		})
+	})
+	return rs, err
+}
+
+// storeFills puts fills into the ledger, already known fills are overwritten
+func storeFills(fills []ledgerFill) error {
+	db, err := openDatabase(ledgerFile, false)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	return db.Update(func(tx *bolt.Tx) error {
+		bucket, err := tx.CreateBucketIfNotExists(fillsBucket)
+		if err != nil {
+			return err
+		}
+		for _, f := range fills {
+			data, err := json.Marshal(f)
+			if err != nil {
+				return err
+			}
+			if err := bucket.Put(f.key(), data); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// importFills queries trade history of every exchange and stores fills into the ledger.
+// When pairs are not set the whole history is requested, pairs of the ledger it misses are
+// queried one by one as well as on exchange without the whole history. Valuations of already
+// known fills are kept.
+func importFills(ctx context.Context, exchanges []wr.Exchange, pairs []string, known []ledgerFill) importResult {
+	resultsChannel := make(chan importResult, len(exchanges))
+	for _, exc := range exchanges {
+		go func(exc wr.Exchange) {
+			var rs importResult
+			calls := 0
+			fetch := func(pair string) {
+				// consecutive history requests are spaced within the exchange request limit
+				if calls++; calls > 1 {
+					select {
+					case <-time.After(exc.PollInterval):
+					case <-ctx.Done():
+					}
+				}
+				channel := make(chan wr.TradeHistoryResponse, 1)
+				go exc.TradeHistory(ctx, pair, channel)
+				history := <-channel
+				if wr.IsHistoryPairRequired(history.Err) {
+					rs.Errs = append(rs.Errs, fmt.Errorf("%s lists trade history per pair only, pairs of the ledger are refreshed, "+
+						"give new ones as arguments: gtr pnl eth_btc doge_usd", exc.Name))
+					return
+				}
+				if history.Err != nil {
+					rs.Errs = append(rs.Errs, history.Err)
+					return
+				}
+				for _, f := range history.Fills {
+					rs.Fills = append(rs.Fills, ledgerFill{Exchange: exc.Name, Fill: f})
+				}
+			}
+			if len(pairs) > 0 {
+				for _, pair := range pairs {
+					fetch(pair)
+				}
+				resultsChannel <- rs
+				return
+			}
+			fetch("")
+			fetched := make(map[string]bool)
+			for _, f := range rs.Fills {
+				fetched[f.Pair] = true
+			}
+			for _, pair := range ledgerPairs(known, exc.Name) {
+				if !fetched[pair] {
+					fetch(pair)
+				}
+			}
+			resultsChannel <- rs
+		}(exc)
+	}
+
+	valuations := make(map[string]decimal.Decimal, len(known))
+	for _, f := range known {
+		valuations[string(f.key())] = f.QuoteUsd
+	}
+	var rs importResult
+	for range exchanges {
+		r := <-resultsChannel
+		for _, f := range r.Fills {
+			f.QuoteUsd = valuations[string(f.key())]
+			rs.Fills = append(rs.Fills, f)
+		}
+		rs.Errs = append(rs.Errs, r.Errs...)
+	}
+	if len(rs.Fills) > 0 {
+		if err := storeFills(rs.Fills); err != nil {
+			rs.Errs = append(rs.Errs, err)
+		}
+	}
+	return rs
+}
+
+// valueFills finds the USD price of the quote currency at the time of every fill not valued yet.
+// Prices are taken from CoinMarketCap history of the fill day, coinsMarket resolves coin ids.
+func valueFills(ctx context.Context, fills []ledgerFill, coinsMarket map[string]coinmarketcap.Coin) ([]ledgerFill, []error) {
+	type quoteDay struct {
+		quote string
+		day   int64
+	}
+	pending := make(map[quoteDay][]ledgerFill)
+	days := make([]quoteDay, 0)
+	rs := make([]ledgerFill, 0)
+	for _, f := range fills {
+		pair, err := wr.ParsePair(f.Pair)
+		if err != nil || f.QuoteUsd.Sign() > 0 {
+			continue
+		}
+		if pair.Quote == fiatCurrency {
+			f.QuoteUsd = decimal.New(1, 0)
+			rs = append(rs, f)
+			continue
+		}
+		d := quoteDay{quote: pair.Quote, day: f.Timestamp - f.Timestamp%secondsPerDay}
+		if _, found := pending[d]; !found {
+			days = append(days, d)
+		}
+		pending[d] = append(pending[d], f)
+	}
+	sort.Slice(days, func(i, j int) bool {
+		if days[i].quote != days[j].quote {
+			return days[i].quote < days[j].quote
+		}
+		return days[i].day < days[j].day
+	})
+
+	var errs []error
+	unlisted := make(map[string]bool)
+	cmc := wr.CoinMarketCap{}
+	for i, d := range days {
+		coin, ok := coinsMarket[d.quote]
+		if !ok {
+			if !unlisted[d.quote] {
+				unlisted[d.quote] = true
+				errs = append(errs, fmt.Errorf("%s is not listed on CoinMarketCap, its fills are not valued in USD", d.quote))
+			}
+			continue
+		}
+		if i > 0 {
+			select {
+			case <-time.After(wr.CoinMarketCapHistoryInterval):
+			case <-ctx.Done():
+			}
+		}
+		channel := make(chan wr.UsdHistoryResponse, 1)
+		go cmc.GetUsdHistory(ctx, coin.ID, d.day, d.day+secondsPerDay, channel)
+		history := <-channel
+		if history.Err != nil {
+			errs = append(errs, history.Err)
+			if ctx.Err() != nil {
+				break
+			}
+			continue
+		}
+		for _, f := range pending[d] {
+			if price, ok := priceAt(history.Prices, f.Timestamp); ok {
+				f.QuoteUsd = price
+				rs = append(rs, f)
+			}
+		}
+	}
+	return rs, errs
+}
+
+// priceAt is the price of the point nearest to the unix time
+func priceAt(prices []wr.PricePoint, timestamp int64) (decimal.Decimal, bool) {
+	var (
+		rs      decimal.Decimal
+		nearest int64 = -1
+	)
+	for _, p := range prices {
+		distance := p.Timestamp - timestamp
+		if distance < 0 {
+			distance = -distance
+		}
+		if p.Usd.Sign() > 0 && (nearest < 0 || distance < nearest) {
+			rs, nearest = p.Usd, distance
+		}
+	}
+	return rs, nearest >= 0
+}
+
+// refreshLedger imports fills and values them in USD unless offline is set and returns
+// the whole ledger with import errors
+func refreshLedger(ctx context.Context, exchanges []wr.Exchange, pairs []string, coinsMarket map[string]coinmarketcap.Coin, offline bool) ([]ledgerFill, []error, error) {
+	fills, err := loadLedger()
+	if err != nil || offline {
+		return fills, nil, err
+	}
+	imported := importFills(ctx, exchanges, pairs, fills)
+	if fills, err = loadLedger(); err != nil {
+		return fills, imported.Errs, err
+	}
+	valued, errs := valueFills(ctx, fills, coinsMarket)
+	errs = append(imported.Errs, errs...)
+	if len(valued) > 0 {
+		if err := storeFills(valued); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	fills, err = loadLedger()
+	return fills, errs, err
+}
+
+// ledgerPairs lists pairs traded on the exchange according to the ledger
+func ledgerPairs(fills []ledgerFill, exchange string) []string {
+	seen := make(map[string]bool)
+	rs := make([]string, 0)
+	for _, f := range fills {
+		if f.Exchange == exchange && !seen[f.Pair] {
+			seen[f.Pair] = true
+			rs = append(rs, f.Pair)
+		}
+	}
+	sort.Strings(rs)
+	return rs
+}
+
+const (
+	termShort = "short"
+	termLong  = "long"
+)
+
+// term is long when the lot was held for more than a year before the disposal
+func (d disposal) term() string {
+	if time.Unix(d.Acquired, 0).AddDate(1, 0, 0).Before(time.Unix(d.Disposed, 0)) {
+		return termLong
+	}
+	return termShort
+}
+
+// yearDisposals returns lots disposed within the calendar year in local time ordered by the disposal.
+// Matching is done over the whole ledger so lots acquired before the year are used. Sales exceeding
+// known acquisitions and sales without USD values are left out and returned as errors per coin.
+func yearDisposals(positions []*position, year int) ([]disposal, []error, []error) {
+	from := time.Date(year, time.January, 1, 0, 0, 0, 0, time.Local).Unix()
+	to := time.Date(year+1, time.January, 1, 0, 0, 0, 0, time.Local).Unix()
+	rs := make([]disposal, 0)
+	var unmatchedErrs, unvaluedErrs []error
+	for _, p := range positions {
+		unmatched, unvalued := decimal.Zero, decimal.Zero
+		for _, d := range p.Disposals {
+			switch {
+			case d.Disposed < from || d.Disposed >= to:
+			case d.Unmatched:
+				unmatched = unmatched.Add(d.Amount)
+			case d.Unvalued:
+				unvalued = unvalued.Add(d.Amount)
+			default:
+				rs = append(rs, d)
+			}
+		}
+		if unmatched.Sign() > 0 {
+			unmatchedErrs = append(unmatchedErrs, fmt.Errorf("%s %s sold in %d has no known acquisition and is not reported, import its trade history", unmatched, p.Coin, year))
+		}
+		if unvalued.Sign() > 0 {
+			unvaluedErrs = append(unvaluedErrs, fmt.Errorf("%s %s sold in %d has no usd price of the sale or the acquisition and is not reported, import again to value it", unvalued, p.Coin, year))
+		}
+	}
+	sort.SliceStable(rs, func(i, j int) bool { return rs[i].Disposed < rs[j].Disposed })
+	return rs, unmatchedErrs, unvaluedErrs
+}
@@ -30,13 +30,12 @@ import (
 	"github.com/olekukonko/tablewriter"
 	"math"
 	"os"
-	"strconv"
 	"strings"
 	"time"
 	"sort"
-	"github.com/ikonovalov/go-yobit"
 	w "github.com/ikonovalov/global-trade/wrappers"
 	"github.com/miguelmota/go-coinmarketcap"
+	"github.com/shopspring/decimal"
 )
 
 var (
@@ -55,51 +54,77 @@ var (
 	coloredPercentage = func(value float64) string {
 		return coloredFloat(value, "%+3.2f")
 	}
-	coloredShift = func(value float64) string {
-		return coloredFloat(value, "%+8.8f")
+	sprintDecimal = func(v decimal.Decimal) string {
+		return v.StringFixed(8)
 	}
-	sprintf64 = func(v float64) string {
-		return fmt.Sprintf("%8.8f", v)
+	coloredDecimalShift = func(value decimal.Decimal) string {
+		color := Gray
+		if value.Sign() > 0 {
+			color = Green
+		}
+		if value.Sign() < 0 {
+			color = Red
+		}
+		return color(value.StringFixed(8)).String()
 	}
+	hundred = decimal.New(100, 0)
 
 
 )
 
+var releaseHooks []func()
+
+// onRelease registers exchange wrappers Release to be called on exit, even the fatal one.
+func onRelease(hooks ...func()) {
+	releaseHooks = append(releaseHooks, hooks...)
+}
+
+func release() {
+	for i := len(releaseHooks) - 1; i >= 0; i-- {
+		releaseHooks[i]()
+	}
+	releaseHooks = nil
+}
+
 func fatal(v ...interface{}) {
-	fmt.Println(Red(Bold(fmt.Sprint(v))).String())
+	fmt.Fprintln(os.Stderr, Red(Bold(fmt.Sprint(v...))).String())
+	release()
 	os.Exit(1)
 }
 
-func printInfoRecords(infoResponse yobit.InfoResponse, currencyFilter string) {
-	table := tablewriter.NewWriter(os.Stdout)
-	table.SetHeader([]string{"Market", "Hidden", "Fee", "Min amount", "Min price", "Max price"})
+func printMarkets(markets []w.Market, currencyFilter string) {
+	table := tablewriter.NewWriter(stdout)
+	table.SetHeader([]string{"Market", "Symbol", "Hidden", "Fee", "Min amount", "Min price", "Max price"})
 	bold := tablewriter.Colors{tablewriter.Bold}
 	norm := tablewriter.Colors{0}
-	table.SetHeaderColor(bold, bold, bold, bold, bold, bold)
-	table.SetColumnColor(bold, norm, norm, norm, norm, norm)
+	table.SetHeaderColor(bold, bold, bold, bold, bold, bold, bold)
+	table.SetColumnColor(bold, norm, norm, norm, norm, norm, norm)
 
-	currencyFilter = strings.ToUpper(currencyFilter)
-	for name, desc := range infoResponse.Pairs {
+	sort.Slice(markets, func(i, j int) bool { return markets[i].Pair.String() < markets[j].Pair.String() })
+	for _, m := range markets {
 		hidden := "NO"
-		if desc.Hidden == 1 {
+		if m.Hidden {
 			hidden = "YES"
 		}
-		if currencyName := strings.ToUpper(name); currencyFilter == "" || strings.Contains(currencyName, currencyFilter) {
+		if marketHasCurrency(m, currencyFilter) {
 			table.Append([]string{
-				currencyName,
-				fmt.Sprintf("%s", hidden),
-				fmt.Sprintf("%2.2f%%", desc.Fee),
-				fmt.Sprintf("%8.8f", desc.MinAmount),
-				fmt.Sprintf("%8.8f", desc.MinPrice),
-				fmt.Sprintf("%8.8f", desc.MaxPrice),
+				strings.ToUpper(m.Pair.String()),
+				m.Symbol,
+				hidden,
+				m.Fee.StringFixed(2) + "%",
+				sprintDecimal(m.MinAmount),
+				sprintDecimal(m.MinPrice),
+				sprintDecimal(m.MaxPrice),
 			})
 		}
 	}
 	table.Render()
 }
 
-func printWallets(coinsMarket map[string]coinmarketcap.Coin, balances []w.Balance, hideZeros bool) {
-	table := tablewriter.NewWriter(os.Stdout)
+// printWallets shows average cost and unrealized PnL columns when costsUsd of the ledger are known
+func printWallets(coinsMarket map[string]coinmarketcap.Coin, balances []w.Balance, costsUsd map[string]decimal.Decimal, hideZeros bool) {
+	table := tablewriter.NewWriter(stdout)
+	withPnl := len(costsUsd) > 0
 	header := []string{
 		"#",
 		"exchange",
@@ -115,27 +140,38 @@ func printWallets(coinsMarket map[string]coinmarketcap.Coin, balances []w.Balanc
 		"volume btc",
 		"gain/loss24H usd",
 		"gain/loss24H btc",
-		"coin",
 	}
+	if withPnl {
+		header = append(header, "avg cost usd", "pnl usd")
+	}
+	header = append(header, "coin")
+	headerColors := make([]tablewriter.Colors, len(header))
+	columnColors := make([]tablewriter.Colors, len(header))
+	for i := range header {
+		headerColors[i] = bold
+		columnColors[i] = norm
+	}
+	columnColors[0], columnColors[1], columnColors[2], columnColors[len(header)-1] = bold, bold, bold, bold
 	table.SetHeader(header)
-	table.SetHeaderColor(bold, bold, bold, bold, bold, bold, bold, bold, bold, bold, bold, bold, bold, bold, bold, )
-	table.SetColumnColor(bold, bold, bold, norm, norm, norm, norm, norm, norm, norm, norm, norm, norm, norm, bold, )
+	table.SetHeaderColor(headerColors...)
+	table.SetColumnColor(columnColors...)
 
 	var (
 		rowCounter              = 0
 		shouldPrintExchangeName = true
-		totalUsdVolume          = 0.0
-		totalBtcVolume          = 0.0
-		totalGainLossUsdVolume  = 0.0
-		totalGainLossBtcVolume  = 0.0
-		onFatOrdersHighlights   = func(ordered float64, volume float64) string {
-			if ordered == 0 {
+		totalUsdVolume          = decimal.Zero
+		totalBtcVolume          = decimal.Zero
+		totalGainLossUsdVolume  = decimal.Zero
+		totalGainLossBtcVolume  = decimal.Zero
+		totalPnlUsd             = decimal.Zero
+		onFatOrdersHighlights   = func(ordered decimal.Decimal, volume decimal.Decimal) string {
+			if ordered.IsZero() {
 				return ""
 			}
-			if ordered-volume == 0 {
-				return Red(fmt.Sprintf("%8.8f", ordered)).String()
+			if ordered.Equal(volume) {
+				return Red(sprintDecimal(ordered)).String()
 			} else {
-				return fmt.Sprintf("%8.8f", ordered)
+				return sprintDecimal(ordered)
 			}
 		}
 		brownIfShitcoin = func(coinName string) string {
@@ -147,8 +183,9 @@ func printWallets(coinsMarket map[string]coinmarketcap.Coin, balances []w.Balanc
 		}
 	)
 
-	for _, balance := range balances {
+	for i, balance := range balances {
 		shouldPrintExchangeName = true
+		isBreakdown := balance.Address != ""
 
 		// order coins by name
 		coins := make([]string, 0, len(balance.Funds))
@@ -159,170 +196,283 @@ func printWallets(coinsMarket map[string]coinmarketcap.Coin, balances []w.Balanc
 
 		for _, coin := range coins {
 			volume := balance.Funds[coin]
-			onOrders := volume - balance.AvailableFunds[coin]
-			if hideZeros && volume == 0 {
+			onOrders := volume.Sub(balance.AvailableFunds[coin])
+			if hideZeros && volume.IsZero() {
 				continue
 			}
-			rowCounter++
+			rowNumber := ""
+			if !isBreakdown {
+				rowCounter++
+				rowNumber = fmt.Sprintf("%d", rowCounter)
+			}
 
 			coinUpperCase := strings.ToUpper(coin)
 			exchangeName := strings.ToUpper(balance.Exchange.Name)
+			if isBreakdown {
+				exchangeName = "  " + addressName(balance)
+			}
 			if !shouldPrintExchangeName {
 				exchangeName = ""
 			}
 
 			coinData := coinsMarket[coinUpperCase]
 
-			volumeUsd := volume * coinData.PriceUsd
-			volumeBtc := volume * coinData.PriceBtc
-			gainLossUsd := volumeUsd * coinData.PercentChange24h / 100
-			gainLossBtc := volumeBtc * coinData.PercentChange24h / 100
-
-			totalUsdVolume += volumeUsd
-			totalBtcVolume += volumeBtc
-			totalGainLossUsdVolume += gainLossUsd
-			totalGainLossBtcVolume += gainLossBtc
+			var (
+				priceUsd         = decimal.NewFromFloat(coinData.PriceUsd)
+				priceBtc         = decimal.NewFromFloat(coinData.PriceBtc)
+				percentChange24h = decimal.NewFromFloat(coinData.PercentChange24h)
+			)
+
+			volumeUsd := volume.Mul(priceUsd)
+			volumeBtc := volume.Mul(priceBtc)
+			gainLossUsd := volumeUsd.Mul(percentChange24h).Div(hundred)
+			gainLossBtc := volumeBtc.Mul(percentChange24h).Div(hundred)
+
+			// address breakdown is already counted by the cold wallet summary
+			if !isBreakdown {
+				totalUsdVolume = totalUsdVolume.Add(volumeUsd)
+				totalBtcVolume = totalBtcVolume.Add(volumeBtc)
+				totalGainLossUsdVolume = totalGainLossUsdVolume.Add(gainLossUsd)
+				totalGainLossBtcVolume = totalGainLossBtcVolume.Add(gainLossBtc)
+			}
 
-			table.Append([]string{
-				fmt.Sprintf("%d", rowCounter),
+			row := []string{
+				rowNumber,
 				exchangeName,
 				brownIfShitcoin(coinUpperCase),
-				sprintf64(volume),
+				sprintDecimal(volume),
 				onFatOrdersHighlights(onOrders, volume),
-				sprintf64(coinData.PriceUsd),
-				sprintf64(coinData.PriceBtc),
+				sprintDecimal(priceUsd),
+				sprintDecimal(priceBtc),
 				coloredPercentage(coinData.PercentChange1h),
 				coloredPercentage(coinData.PercentChange24h),
 				coloredPercentage(coinData.PercentChange7d),
-				sprintf64(volumeUsd),
-				sprintf64(volumeBtc),
-				coloredShift(gainLossUsd),
-				coloredShift(gainLossBtc),
-				brownIfShitcoin(coinUpperCase),
-			})
+				sprintDecimal(volumeUsd),
+				sprintDecimal(volumeBtc),
+				coloredDecimalShift(gainLossUsd),
+				coloredDecimalShift(gainLossBtc),
+			}
+			if withPnl {
+				if costUsd, ok := costsUsd[coinUpperCase]; ok {
+					pnlUsd := volume.Mul(priceUsd.Sub(costUsd))
+					if !isBreakdown {
+						totalPnlUsd = totalPnlUsd.Add(pnlUsd)
+					}
+					row = append(row, sprintDecimal(costUsd), coloredDecimalShift(pnlUsd))
+				} else {
+					row = append(row, "", "")
+				}
+			}
+			table.Append(append(row, brownIfShitcoin(coinUpperCase)))
 			shouldPrintExchangeName = false
 		}
-		table.Append([]string{"", "", "", "", "", "", "", "", "", "", "", "", "",})
+		if i+1 < len(balances) && balances[i+1].Address != "" {
+			continue
+		}
+		table.Append(make([]string, len(header)))
 	}
-	table.SetFooter([]string{
+	footer := []string{
 		"", "", "", "", "", "", "", "", "",
-		"Total cap", sprintf64(totalUsdVolume), sprintf64(totalBtcVolume),
-		sprintf64(totalGainLossUsdVolume), sprintf64(totalGainLossBtcVolume),
-		"",
-	})
+		"Total cap", sprintDecimal(totalUsdVolume), sprintDecimal(totalBtcVolume),
+		sprintDecimal(totalGainLossUsdVolume), sprintDecimal(totalGainLossBtcVolume),
+	}
+	if withPnl {
+		footer = append(footer, "", sprintDecimal(totalPnlUsd))
+	}
+	table.SetFooter(append(footer, ""))
 
 	table.Render()
-	fmt.Printf("Snapshot: %s\n", time.Now().Format(time.Stamp))
-	fmt.Print("\nLegend\n")
-	fmt.Printf("%s - Is it a shitcoin?\n", BgBrown(" "))
-	fmt.Printf("* - https://coinmarketcap.com/ prices\n")
+	fmt.Fprintf(stdout, "Snapshot: %s\n", time.Now().Format(time.Stamp))
+	fmt.Fprint(stdout, "\nLegend\n")
+	fmt.Fprintf(stdout, "%s - Is it a shitcoin?\n", BgBrown(" "))
+	fmt.Fprintf(stdout, "* - https://coinmarketcap.com/ prices\n")
+	if withPnl {
+		fmt.Fprintf(stdout, "avg cost usd - %s cost basis of the trade ledger, see pnl command\n", *appCostMethod)
+	}
 }
 
-func printOffers(offers yobit.Offers) {
+// addressName is the label of the cold wallet address followed by the shortened address
+func addressName(balance w.Balance) string {
+	address := balance.Address
+	if len(address) > 16 {
+		address = address[:8] + ".." + address[len(address)-6:]
+	}
+	if balance.Label == "" {
+		return address
+	}
+	return fmt.Sprintf("%s (%s)", balance.Label, address)
+}
+
+// printSourceErrors goes to stderr for machine-readable output formats
+func printSourceErrors(errs []error) {
+	printErrors("Failed sources", errs)
+}
+
+// printErrors lists errors under the title after the table, on stderr for machine readable output
+func printErrors(title string, errs []error) {
+	if len(errs) == 0 {
+		return
+	}
+	out := stdout
+	if *appOutput != outputTable {
+		out = os.Stderr
+	}
+	fmt.Fprintf(out, "\n%s\n", Bold(Red(title)))
+	for _, err := range errs {
+		fmt.Fprintf(out, "%s\n", Red(err.Error()))
+	}
+}
+
+func printOffers(book w.OrderBook, settings wallSettings, impactAmount decimal.Decimal) {
 	var (
-		asks    = offers.Asks
-		bids    = offers.Bids
-		asksLen = len(asks)
-		bidsLen = len(bids)
-		depth   = math.Max(float64(asksLen), float64(bidsLen))
+		asks  = analyzeDepth(book.Asks, settings)
+		bids  = analyzeDepth(book.Bids, settings)
+		depth = math.Max(float64(len(asks)), float64(len(bids)))
+		walls = 0
 	)
-	table := tablewriter.NewWriter(os.Stdout)
+	table := tablewriter.NewWriter(stdout)
 	table.SetHeader([]string{
 		"#",
 		"ask price",
 		"ask quantity",
+		"ask total",
+		"ask total quote",
 		"bid price",
 		"bid quantity",
+		"bid total",
+		"bid total quote",
 	})
-	table.SetHeaderColor(bold, bold, bold, bold, bold)
-	table.SetColumnColor(norm, norm, norm, norm, norm)
-
-	appendOffer := func(row []string, offer yobit.Offer, wall bool) []string {
-		qnt := sprintf64(offer.Quantity)
-		if wall {
-			qnt = Bold(qnt).String()
+	table.SetHeaderColor(bold, bold, bold, bold, bold, bold, bold, bold, bold)
+	table.SetColumnColor(norm, norm, norm, norm, norm, norm, norm, norm, norm)
+
+	appendOffer := func(row []string, offer depthLevel) []string {
+		qnt := sprintDecimal(offer.Quantity)
+		if offer.Wall {
+			walls++
+			qnt = Bold(Brown(qnt)).String()
 		}
-		return append(row, sprintf64(offer.Price), qnt)
+		return append(row, sprintDecimal(offer.Price), qnt, sprintDecimal(offer.CumulativeQuantity), sprintDecimal(offer.CumulativeNotional))
 	}
 
 	appendEmpty := func(row []string) []string {
-		return append(row, "", "")
-	}
-
-	passingWall := func(index int, offers []yobit.Offer) bool { // TODO Need smarter algorithm!
-		if index == len(offers)-1 {
-			return false
-		}
-		offer := offers[index]
-		nextOffer := offers[index+1]
-		return offer.Quantity > nextOffer.Quantity*700.0
+		return append(row, "", "", "", "")
 	}
 
 	for i := 0; i < int(depth); i++ {
-		row := append(make([]string, 0, 4), fmt.Sprintf("%d", i+1))
+		row := append(make([]string, 0, 9), fmt.Sprintf("%d", i+1))
 
-		if i < asksLen {
-			ask := asks[i]
-			row = appendOffer(row, ask, passingWall(i, asks))
+		if i < len(asks) {
+			row = appendOffer(row, asks[i])
 		} else {
 			row = appendEmpty(row)
 		}
-		if i < bidsLen {
-			bid := bids[i]
-			row = appendOffer(row, bid, passingWall(i, bids))
+		if i < len(bids) {
+			row = appendOffer(row, bids[i])
 		} else {
 			row = appendEmpty(row)
 		}
 		table.Append(row)
 	}
 	table.Render()
+	if walls > 0 {
+		fmt.Fprintf(stdout, "%s - wall: quantity z-score >= %.2f, at least %s%% of the total, worth %s quote at least\n",
+			Bold(Brown("quantity")), settings.Sensitivity, wallDepthShare.Mul(hundred), settings.MinNotional)
+	}
+	if impactAmount.Sign() > 0 {
+		printImpact(estimateImpact(w.SideBuy, book.Asks, impactAmount))
+		printImpact(estimateImpact(w.SideSell, book.Bids, impactAmount))
+	}
 }
 
-func lastHiGreen(first float64, second float64) (func(arg interface{}) Value) {
-	if first > second {
+func printImpact(impact priceImpact) {
+	fmt.Fprintf(stdout, "%-4s %s: average %s, worst %s, impact %s\n",
+		impact.Side,
+		impact.Amount,
+		sprintDecimal(impact.AveragePrice),
+		sprintDecimal(impact.WorstPrice),
+		signedPercent(impact.Impact, "%"),
+	)
+	if impact.Filled.LessThan(impact.Amount) {
+		fmt.Fprintf(stdout, "     %s\n", Brown(fmt.Sprintf("only %s is visible, increase the depth limit", impact.Filled)))
+	}
+}
+
+func lastHiGreen(first decimal.Decimal, second decimal.Decimal) (func(arg interface{}) Value) {
+	if first.GreaterThan(second) {
 		return Red
-	} else if first == second {
+	} else if first.Equal(second) {
 		return Gray
 	} else {
 		return Green
 	}
 }
 
-func printTicker(ticker yobit.Ticker, tickerName string) {
-	spread := ticker.Sell - ticker.Buy
-	spreadPercent := spread / ticker.Last * float64(100)
-	updated := time.Unix(ticker.Updated, 0).Format(time.Stamp)
+// percentOf is the change from base to value in percents, zero for zero base
+func percentOf(value decimal.Decimal, base decimal.Decimal) decimal.Decimal {
+	if base.IsZero() {
+		return decimal.Zero
+	}
+	return value.Sub(base).Div(base).Mul(hundred)
+}
+
+// sprintTickerChange is the last price change against the price 24h ago or the 24h average,
+// empty when the exchange reports neither
+func sprintTickerChange(ticker w.Ticker) string {
+	base := ticker.PrevDay
+	if base.IsZero() {
+		base = ticker.Avg
+	}
+	if base.IsZero() {
+		return ""
+	}
+	return lastHiGreen(base, ticker.Last)(signedPercent(percentOf(ticker.Last, base), "%")).String()
+}
 
-	table := tablewriter.NewWriter(os.Stdout)
-	diffLastAvgPercent := (ticker.Last - ticker.Avg) / ticker.Avg * float64(100)
-	diffLowAvgPercent := (ticker.Avg - ticker.Low) / ticker.Low * float64(100)
+func printTicker(ticker w.Ticker, tickerName string) {
+	spread := ticker.Sell.Sub(ticker.Buy)
+	spreadPercent := decimal.Zero
+	if !ticker.Last.IsZero() {
+		spreadPercent = spread.Div(ticker.Last).Mul(hundred)
+	}
+	updated := time.Unix(ticker.Updated, 0).Format(time.Stamp)
 
+	table := tablewriter.NewWriter(stdout)
 	table.SetHeader([]string{Bold(tickerName).String(), ""})
 	table.SetColumnColor(bold, norm)
-	table.Append([]string{"HIGH", sprintf64(ticker.High)})
-	table.Append([]string{"LOW", sprintf64(ticker.Low)})
-	table.Append([]string{
-		"AVG", lastHiGreen(ticker.Low, ticker.Avg)(fmt.Sprintf("%8.8f\u00A0%+3.2f", ticker.Avg, diffLowAvgPercent)).String(),
-	})
-	table.Append([]string{
-		"LAST",
-		lastHiGreen(ticker.Avg, ticker.Last)(fmt.Sprintf("%8.8f\u00A0%+3.2f%%", ticker.Last, diffLastAvgPercent)).String(),
-	})
-	table.Append([]string{"BUY", sprintf64(ticker.Buy)})
-	table.Append([]string{"SELL", sprintf64(ticker.Sell)})
-	table.Append([]string{"SPREAD", lastHiGreen(0.5, spreadPercent)(fmt.Sprintf("%s\u00A0%+3.2f%%", sprintf64(spread), spreadPercent)).String()})
-	table.Append([]string{"VOLUME", sprintf64(ticker.Vol)})
-	table.Append([]string{"VOLUME CUR", sprintf64(ticker.VolCur)})
-
-	fmt.Printf("%s\n", updated)
+	table.Append([]string{"HIGH", sprintDecimal(ticker.High)})
+	table.Append([]string{"LOW", sprintDecimal(ticker.Low)})
+	if !ticker.Avg.IsZero() {
+		table.Append([]string{
+			"AVG", lastHiGreen(ticker.Low, ticker.Avg)(fmt.Sprintf("%s\u00A0%s", sprintDecimal(ticker.Avg), signedPercent(percentOf(ticker.Avg, ticker.Low), ""))).String(),
+		})
+	}
+	if !ticker.PrevDay.IsZero() {
+		table.Append([]string{"PREV DAY", sprintDecimal(ticker.PrevDay)})
+	}
+	table.Append([]string{"LAST", sprintDecimal(ticker.Last) + "\u00A0" + sprintTickerChange(ticker)})
+	table.Append([]string{"BUY", sprintDecimal(ticker.Buy)})
+	table.Append([]string{"SELL", sprintDecimal(ticker.Sell)})
+	table.Append([]string{"SPREAD", lastHiGreen(decimal.New(5, -1), spreadPercent)(fmt.Sprintf("%s\u00A0%s", sprintDecimal(spread), signedPercent(spreadPercent, "%"))).String()})
+	table.Append([]string{"VOLUME", sprintDecimal(ticker.Vol)})
+	table.Append([]string{"VOLUME CUR", sprintDecimal(ticker.VolCur)})
+
+	fmt.Fprintf(stdout, "%s\n", updated)
 	table.Render()
 }
 
-func printTradeHistory(history yobit.TradeHistoryResponse) {
-	//updated := time.Unix(ticker.Updated, 0).Format(time.Stamp)
-	table := tablewriter.NewWriter(os.Stdout)
-	table.SetHeader([]string{"tx id", "pair", "type", "rate", "amount", "time", "your order"})
-	table.SetColumnColor(bold, bold, norm, norm, norm, norm, norm)
+// signedPercent formats value with 2 decimal places and the explicit sign
+func signedPercent(value decimal.Decimal, suffix string) string {
+	rs := value.StringFixed(2)
+	if value.Sign() >= 0 {
+		rs = "+" + rs
+	}
+	return rs + suffix
+}
+
+func printTradeHistory(history []w.Fill) {
+	table := tablewriter.NewWriter(stdout)
+	table.SetHeader([]string{"tx id", "pair", "type", "rate", "amount", "fee", "time", "order id"})
+	table.SetColumnColor(bold, bold, norm, norm, norm, norm, norm, norm)
 	directionMarker := func(dir string) string {
 		dir = strings.ToUpper(dir)
 		if dir == "BUY" {
@@ -331,51 +481,366 @@ func printTradeHistory(history yobit.TradeHistoryResponse) {
 			return BgRed(dir).String()
 		}
 	}
-	isYourOrderStr := func(flag uint8) string {
-		if flag == 1 {
-			return "YES"
-		} else {
-			return "NO"
+	sort.Slice(history, func(i, j int) bool { return history[i].Timestamp < history[j].Timestamp })
+	for _, fill := range history {
+		table.Append([]string{
+			fill.Id,
+			strings.ToUpper(fill.Pair),
+			directionMarker(fill.Side),
+			sprintDecimal(fill.Rate),
+			sprintDecimal(fill.Amount),
+			sprintDecimal(fill.Fee),
+			time.Unix(fill.Timestamp, 0).Format(time.Stamp),
+			fill.OrderId,
+		})
+	}
+	table.Render()
+}
+
+func printPnl(records []pnlRecord, unmatched bool, unvalued bool) {
+	table := tablewriter.NewWriter(stdout)
+	table.SetHeader([]string{"coin", "amount", "avg cost", "cost basis", "price*", "market value", "unrealized", "realized"})
+	table.SetColumnColor(bold, norm, norm, norm, norm, norm, norm, norm)
+	var (
+		totalUnrealized = decimal.Zero
+		totalRealized   = decimal.Zero
+	)
+	for _, r := range records {
+		totalUnrealized = totalUnrealized.Add(r.Unrealized)
+		totalRealized = totalRealized.Add(r.Realized)
+		coin := r.Coin
+		if r.Unmatched.Sign() > 0 {
+			coin = Brown(coin + "!").String()
+		}
+		if r.Unvalued {
+			coin = Brown(coin + "?").String()
 		}
+		table.Append([]string{
+			coin,
+			sprintDecimal(r.Amount),
+			sprintDecimal(r.AverageCost),
+			sprintDecimal(r.CostBasis),
+			sprintDecimal(r.Price),
+			sprintDecimal(r.MarketValue),
+			coloredDecimalShift(r.Unrealized),
+			coloredDecimalShift(r.Realized),
+		})
 	}
-	txs := make([]string, 0, len(history.Orders))
-	for tx := range history.Orders {
-		txs = append(txs, tx)
+	table.SetFooter([]string{"", "", "", "", "", "Total usd", sprintDecimal(totalUnrealized), sprintDecimal(totalRealized)})
+	table.Render()
+	fmt.Fprintf(stdout, "Cost method: %s. Amounts are in usd at the fill time, coins spent and received as quote are included.\n", *appCostMethod)
+	fmt.Fprintf(stdout, "* - https://coinmarketcap.com/ prices\n")
+	if unmatched {
+		fmt.Fprintf(stdout, "%s - sold more than bought according to the ledger, the excess is left out of realized\n", Brown("!"))
+	}
+	if unvalued {
+		fmt.Fprintf(stdout, "%s - fills without usd price at the fill time are counted at zero, import again to value them\n", Brown("?"))
+	}
+}
+
+func printTaxReport(year int, records []taxLotRecord) {
+	table := tablewriter.NewWriter(stdout)
+	table.SetHeader([]string{"coin", "amount", "acquired", "sold", "proceeds", "cost", "gain", "term"})
+	table.SetColumnColor(bold, norm, norm, norm, norm, norm, norm, norm)
+	totals := make(map[string]decimal.Decimal)
+	for _, r := range records {
+		totals[r.Term] = totals[r.Term].Add(r.Gain)
+		table.Append([]string{
+			r.Coin,
+			sprintDecimal(r.Amount),
+			r.DateAcquired,
+			r.DateSold,
+			sprintDecimal(r.Proceeds),
+			sprintDecimal(r.Cost),
+			coloredDecimalShift(r.Gain),
+			r.Term,
+		})
+	}
+	table.Render()
+
+	terms := make([]string, 0, len(totals))
+	for term := range totals {
+		terms = append(terms, term)
+	}
+	sort.Strings(terms)
+	fmt.Fprintf(stdout, "%s\n", Bold(fmt.Sprintf("Gains %d in usd, %s cost method", year, *appCostMethod)))
+	for _, term := range terms {
+		fmt.Fprintf(stdout, "%-8s %s\n", term, coloredDecimalShift(totals[term]))
+	}
+}
+
+func printArb(records []arbRecord) {
+	table := tablewriter.NewWriter(stdout)
+	table.SetHeader([]string{"pair", "buy on", "ask", "fee %", "sell on", "bid", "fee %", "net spread %", "top amount", "executable", "profit"})
+	table.SetColumnColor(bold, norm, norm, norm, norm, norm, norm, bold, norm, norm, norm)
+	unknownFunds := false
+	for _, r := range records {
+		executable := sprintDecimal(r.ExecutableAmount)
+		if !r.FundsKnown {
+			unknownFunds = true
+			executable = Brown(executable + "!").String()
+		}
+		table.Append([]string{
+			strings.ToUpper(r.Pair),
+			r.BuyExchange,
+			sprintDecimal(r.BuyPrice),
+			r.BuyFee.String(),
+			r.SellExchange,
+			sprintDecimal(r.SellPrice),
+			r.SellFee.String(),
+			coloredDecimalShift(r.NetSpread),
+			sprintDecimal(r.TopAmount),
+			executable,
+			coloredDecimalShift(r.Profit),
+		})
+	}
+	table.Render()
+	fmt.Fprintf(stdout, "Prices are the best order book levels, spread and profit are net of taker fees, profit is in quote currency.\n")
+	if unknownFunds {
+		fmt.Fprintf(stdout, "%s - balances are unknown, the amount is limited by the order books only\n", Brown("!"))
+	}
+}
+
+func printSnapshots(snapshots []portfolioSnapshot) {
+	table := tablewriter.NewWriter(stdout)
+	table.SetHeader([]string{"id", "taken", "holdings", "value usd*", "value btc*", "failed sources"})
+	table.SetColumnColor(bold, norm, norm, norm, norm, norm)
+	for _, s := range snapshots {
+		table.Append([]string{
+			fmt.Sprintf("%d", s.Id),
+			time.Unix(s.Taken, 0).Format("2006-01-02 15:04"),
+			fmt.Sprintf("%d", len(s.Holdings)),
+			sprintDecimal(s.valueUsd()),
+			sprintDecimal(s.valueBtc()),
+			Red(strings.Join(s.Failed, "\n")).String(),
+		})
+	}
+	table.Render()
+	fmt.Fprintf(stdout, "* - https://coinmarketcap.com/ prices at the time of the snapshot\n")
+}
+
+func printTriggers(triggers []conditionalOrder) {
+	table := tablewriter.NewWriter(stdout)
+	table.SetHeader([]string{"id", "created", "kind", "exchange", "pair", "side", "fires", "rate", "amount", "status", "order id"})
+	table.SetColumnColor(bold, norm, norm, norm, bold, norm, norm, norm, norm, norm, norm)
+	for _, o := range triggers {
+		status := o.Status
+		switch o.Status {
+		case triggerFired, triggerFilled:
+			status = Green(o.Status).String()
+		case triggerFailed:
+			status = Red(o.Status + ": " + o.Error).String()
+		case triggerFiring:
+			status = Brown(o.Status).String()
+		}
+		table.Append([]string{
+			fmt.Sprintf("%d", o.Id),
+			time.Unix(o.Created, 0).Format("2006-01-02 15:04"),
+			o.Kind,
+			o.Exchange,
+			strings.ToUpper(o.Pair),
+			strings.ToUpper(o.Side),
+			sprintTriggerLevel(o),
+			sprintTriggerRate(o),
+			sprintDecimal(o.Amount),
+			status,
+			o.OrderId,
+		})
+	}
+	table.Render()
+}
+
+// sprintTriggerLevel is the price firing the trigger, trailing stop shows its distance from the extreme
+func sprintTriggerLevel(o conditionalOrder) string {
+	level := o.Direction + " " + sprintDecimal(o.Trigger)
+	if o.Kind == triggerOco {
+		return fmt.Sprintf("%s, take %s order %s filled %s", level, sprintDecimal(o.Take), o.TakeOrderId, sprintDecimal(o.Filled))
+	}
+	if o.Kind != triggerTrailingStop {
+		return level
+	}
+	trail := sprintDecimal(o.Trail)
+	if o.TrailPercent {
+		trail = o.Trail.String() + "%"
+	}
+	extreme := "high"
+	if o.Side == w.SideBuy {
+		extreme = "low"
+	}
+	return fmt.Sprintf("%s, %s from %s %s %s", level, trail, o.Source, extreme, sprintDecimal(o.Extreme))
+}
+
+// sprintTriggerRate is the order rate, unfired trailing stop shows the offset from the price
+func sprintTriggerRate(o conditionalOrder) string {
+	if o.Kind == triggerTrailingStop && o.Rate.IsZero() {
+		sign := "-"
+		if o.Side == w.SideBuy {
+			sign = "+"
+		}
+		return fmt.Sprintf("price %s%s%%", sign, o.Offset)
+	}
+	return sprintDecimal(o.Rate)
+}
+
+// printTriggerEvent reports the trigger adjusted, fired or failed by the daemon at the price
+func printTriggerEvent(o conditionalOrder, event string, price decimal.Decimal) {
+	at := ""
+	if price.Sign() > 0 {
+		at = fmt.Sprintf(" at %s", sprintDecimal(price))
+	}
+	switch event {
+	case eventAdjusted:
+		fmt.Fprintf(stdout, "%s %s %d adjusted%s: %s %s\n",
+			time.Now().Format(time.Stamp), o.Kind, o.Id, at, o.Direction, sprintDecimal(o.Trigger))
+	case triggerFired:
+		fmt.Fprintf(stdout, "%s %s %d fired%s: %s %s amount: %s rate: %s, order %s\n",
+			time.Now().Format(time.Stamp), o.Kind, o.Id, at, strings.ToUpper(o.Side), strings.ToUpper(o.Pair),
+			sprintDecimal(o.Amount), sprintDecimal(o.Rate), o.OrderId)
+	case eventResized:
+		fmt.Fprintf(stdout, "%s %s %d take order %s filled %s, stop amount %s\n",
+			time.Now().Format(time.Stamp), o.Kind, o.Id, o.TakeOrderId, sprintDecimal(o.Filled), sprintDecimal(o.Amount))
+	case triggerFilled:
+		fmt.Fprintf(stdout, "%s %s %d filled%s: take order %s filled %s, the stop is cancelled\n",
+			time.Now().Format(time.Stamp), o.Kind, o.Id, at, o.TakeOrderId, sprintDecimal(o.Filled))
+	default:
+		fmt.Fprintf(stdout, "%s %s %d %s%s: %s\n",
+			time.Now().Format(time.Stamp), o.Kind, o.Id, event, at, Red(o.Error))
 	}
-	sort.Strings(txs)
-	for _, tx := range txs {
-		hOrder := history.Orders[tx]
-		timestamp, _ := strconv.ParseInt(hOrder.Timestamp, 10, 64)
-		timestampStr := time.Unix(timestamp, 0).Format(time.Stamp)
+}
+
+func printTriggerEvents(events []triggerEvent) {
+	table := tablewriter.NewWriter(stdout)
+	table.SetHeader([]string{"time", "trigger", "event", "price", "level", "extreme", "message"})
+	table.SetColumnColor(norm, bold, norm, norm, norm, norm, norm)
+	for _, e := range events {
 		table.Append([]string{
-			tx,
-			strings.ToUpper(hOrder.Pair),
-			directionMarker(hOrder.Type),
-			sprintf64(hOrder.Rate),
-			sprintf64(hOrder.Amount),
-			timestampStr,
-			isYourOrderStr(hOrder.IsYourOrder),
+			time.Unix(e.Time, 0).Format(time.Stamp),
+			fmt.Sprintf("%d", e.Trigger),
+			e.Event,
+			sprintDecimal(e.Price),
+			sprintDecimal(e.Level),
+			sprintDecimal(e.Extreme),
+			e.Message,
 		})
 	}
 	table.Render()
 }
 
-func printTrades(trades []yobit.Trade) {
+func printSnapshotDiff(from, to portfolioSnapshot, diff []snapshotDiffRecord) {
+	fmt.Fprintf(stdout, "Snapshot %d (%s) \u21D2 %d (%s)\n",
+		from.Id, time.Unix(from.Taken, 0).Format(time.Stamp),
+		to.Id, time.Unix(to.Taken, 0).Format(time.Stamp),
+	)
+	table := tablewriter.NewWriter(stdout)
+	table.SetHeader([]string{"exchange", "coin", "hold from", "hold to", "change", "usd from*", "usd to*", "usd change", "btc change"})
+	table.SetColumnColor(bold, bold, norm, norm, norm, norm, norm, norm, norm)
+	var (
+		totalUsdChange = decimal.Zero
+		totalBtcChange = decimal.Zero
+	)
+	for _, d := range diff {
+		if d.HoldChange.IsZero() && d.ValueUsdChange.IsZero() && d.ValueBtcChange.IsZero() {
+			continue
+		}
+		totalUsdChange = totalUsdChange.Add(d.ValueUsdChange)
+		totalBtcChange = totalBtcChange.Add(d.ValueBtcChange)
+		table.Append([]string{
+			strings.ToUpper(d.Exchange),
+			d.Coin,
+			sprintDecimal(d.HoldFrom),
+			sprintDecimal(d.HoldTo),
+			coloredDecimalShift(d.HoldChange),
+			sprintDecimal(d.ValueUsdFrom),
+			sprintDecimal(d.ValueUsdTo),
+			coloredDecimalShift(d.ValueUsdChange),
+			coloredDecimalShift(d.ValueBtcChange),
+		})
+	}
+	table.SetFooter([]string{
+		"", "", "", "", "",
+		sprintDecimal(from.valueUsd()), sprintDecimal(to.valueUsd()),
+		sprintDecimal(totalUsdChange), sprintDecimal(totalBtcChange),
+	})
+	table.Render()
+	for _, s := range []portfolioSnapshot{from, to} {
+		if len(s.Failed) > 0 {
+			fmt.Fprintf(stdout, "%s\n", Red(fmt.Sprintf("Snapshot %d misses sources: %s", s.Id, strings.Join(s.Failed, "; "))))
+		}
+	}
+	fmt.Fprintf(stdout, "* - https://coinmarketcap.com/ prices at the time of the snapshot\n")
+}
+
+func printTrades(trades []w.Trade) {
 	for _, trade := range trades {
 		tm := time.Unix(trade.Timestamp, 0).Format(time.Stamp)
 		Colored := BgGreen
 		tradeDirection := "Buy "
-		if trade.Type == "ask" {
+		if trade.Side == w.SideSell {
 			Colored = BgRed
 			tradeDirection = "Sell"
 		}
 
-		fmt.Printf("%s %s Price[%.8f] Amount[%.8f] \u21D0 %d\n", tm, Bold(Colored(tradeDirection)), trade.Price, trade.Amount, trade.Tid)
+		fmt.Fprintf(stdout, "%s %s Price[%s] Amount[%s] \u21D0 %s\n", tm, Bold(Colored(tradeDirection)), sprintDecimal(trade.Price), sprintDecimal(trade.Amount), trade.Id)
 	}
 }
 
-func printTradeResult(trade yobit.TradeResult) {
-	table := tablewriter.NewWriter(os.Stdout)
+func printOrderPreview(preview orderPreview) {
+	pair, _ := w.ParsePair(preview.Pair)
+	table := tablewriter.NewWriter(stdout)
+	table.SetHeader([]string{Bold(strings.ToUpper(preview.Side + " " + preview.Pair)).String(), preview.Exchange})
+	table.SetColumnColor(bold, norm)
+	table.Append([]string{"RATE", sprintDecimal(preview.Rate) + " " + pair.Quote})
+	table.Append([]string{"AMOUNT", sprintDecimal(preview.Amount) + " " + pair.Base})
+	table.Append([]string{"TOTAL", sprintDecimal(preview.Total) + " " + pair.Quote})
+	table.Append([]string{"FEE", fmt.Sprintf("%s %s (%s%%)", sprintDecimal(preview.Fee), pair.Quote, preview.FeePercent)})
+	table.Append([]string{"LAST", sprintDecimal(preview.Last)})
+	table.Append([]string{"DEVIATION", signedPercent(preview.Deviation, "%")})
+	table.Render()
+}
+
+// printOcoStop describes the stop of the OCO placed when the take order is
+func printOcoStop(o conditionalOrder) {
+	fmt.Fprintf(stdout, "Stop: %s %s rate %s once the last price is %s %s, the take order is cancelled then\n",
+		strings.ToUpper(o.Side), strings.ToUpper(o.Pair), sprintDecimal(o.Rate), o.Direction, sprintDecimal(o.Trigger))
+}
+
+func printTwapPlan(plan twapPlan) {
+	interval := plan.Duration / time.Duration(plan.Slices)
+	limit := "at least"
+	if plan.Side == w.SideBuy {
+		limit = "at most"
+	}
+	fmt.Fprintf(stdout, "TWAP: %d slices of %s every %s, rate %s %s\n",
+		plan.Slices, sprintDecimal(plan.scheduled(0)), interval, limit, sprintDecimal(plan.Limit))
+	if plan.Visible.Sign() > 0 {
+		fmt.Fprintf(stdout, "Iceberg: child orders show %s at most\n", sprintDecimal(plan.Visible))
+	}
+}
+
+func printTwapReport(report twapReport) {
+	pair, _ := w.ParsePair(report.Pair)
+	table := tablewriter.NewWriter(stdout)
+	table.SetHeader([]string{Bold(strings.ToUpper("twap " + report.Side + " " + report.Pair)).String(), report.Exchange})
+	table.SetColumnColor(bold, norm)
+	table.Append([]string{"FILLED", fmt.Sprintf("%s of %s %s", sprintDecimal(report.Filled), sprintDecimal(report.Total), pair.Base)})
+	table.Append([]string{"UNFILLED", sprintDecimal(report.Total.Sub(report.Filled))})
+	table.Append([]string{"CHILD ORDERS", fmt.Sprintf("%d", len(report.Children))})
+	table.Append([]string{"AVERAGE PRICE", sprintDecimal(report.AveragePrice) + " " + pair.Quote})
+	table.Append([]string{"ARRIVAL PRICE", sprintDecimal(report.ArrivalPrice) + " " + pair.Quote})
+	slippage := signedPercent(report.Slippage, "%")
+	if report.Slippage.Sign() > 0 {
+		slippage = Red(slippage).String()
+	}
+	table.Append([]string{"SLIPPAGE", slippage})
+	table.Append([]string{"DURATION", (time.Duration(report.Finished-report.Started) * time.Second).String()})
+	table.Render()
+	if report.Interrupted {
+		fmt.Fprintln(stdout, "Interrupted, the working child order is cancelled")
+	}
+}
+
+func printTradeResult(trade w.OrderResult) {
+	table := tablewriter.NewWriter(stdout)
 	table.SetHeader([]string{
 		"OrderId",
 		"Received",
@@ -384,46 +849,51 @@ func printTradeResult(trade yobit.TradeResult) {
 	table.SetHeaderColor(bold, bold, bold)
 	table.SetColumnColor(bold, norm, norm)
 	table.Append([]string{
-		fmt.Sprintf("%d", trade.OrderId),
-		fmt.Sprintf("%8.8f", trade.Received),
-		fmt.Sprintf("%8.8f", trade.Remains),
+		trade.OrderId,
+		sprintDecimal(trade.Received),
+		sprintDecimal(trade.Remains),
 	})
 	table.Render()
 }
 
-func printActiveOrders(activeOrders yobit.ActiveOrdersResponse) {
-	for ordId, ord := range activeOrders.Orders {
-		created, _ := strconv.ParseInt(ord.Created, 10, 64)
-		fmt.Printf("%s ID[%s] %s amount: %.8f rate: %.8f\n",
-			time.Unix(created, 0).Format(time.Stamp), ordId, strings.ToUpper(ord.Type), ord.Amount, ord.Rate)
+func printActiveOrders(activeOrders []w.Order) {
+	sort.Slice(activeOrders, func(i, j int) bool { return activeOrders[i].Created < activeOrders[j].Created })
+	for _, ord := range activeOrders {
+		fmt.Fprintf(stdout, "%s ID[%s] %s %s amount: %s rate: %s\n",
+			time.Unix(ord.Created, 0).Format(time.Stamp), ord.Id, strings.ToUpper(ord.Pair), strings.ToUpper(ord.Side),
+			sprintDecimal(ord.Amount), sprintDecimal(ord.Rate))
 	}
 }
 
-func printOrderInfo(orders map[string]yobit.OrderInfo) {
-	table := tablewriter.NewWriter(os.Stdout)
+func printOrderInfo(order w.Order) {
+	table := tablewriter.NewWriter(stdout)
 	table.SetHeader([]string{
 		"orderid",
 		"pair",
+		"type",
 		"start amount",
 		"amount",
 		"fill",
 		"rate",
+		"status",
 		"created",
 	})
-	table.SetHeaderColor(bold, bold, bold, bold, bold, bold, bold)
-	table.SetColumnColor(bold, bold, norm, norm, norm, norm, norm)
-	for order, info := range orders {
-		orderTime, _ := strconv.ParseInt(info.Created, 10, 64)
-		fill := math.Abs(info.Amount-info.StartAmount) / info.StartAmount * float64(100)
-		table.Append([]string{
-			order,
-			strings.ToUpper(info.Pair),
-			sprintf64(info.StartAmount),
-			sprintf64(info.Amount),
-			fmt.Sprintf("%3.2f%%", fill),
-			sprintf64(info.Rate),
-			time.Unix(orderTime, 0).Format(time.Stamp),
-		})
+	table.SetHeaderColor(bold, bold, bold, bold, bold, bold, bold, bold, bold)
+	table.SetColumnColor(bold, bold, norm, norm, norm, norm, norm, norm, norm)
+	fill := decimal.Zero
+	if order.StartAmount.Sign() > 0 {
+		fill = order.StartAmount.Sub(order.Amount).Abs().Div(order.StartAmount).Mul(hundred)
 	}
+	table.Append([]string{
+		order.Id,
+		strings.ToUpper(order.Pair),
+		strings.ToUpper(order.Side),
+		sprintDecimal(order.StartAmount),
+		sprintDecimal(order.Amount),
+		fill.StringFixed(2)+"%",
+		sprintDecimal(order.Rate),
+		order.Status.String(),
+		time.Unix(order.Created, 0).Format(time.Stamp),
+	})
 	table.Render()
 }
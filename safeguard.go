@@ -0,0 +1,215 @@
+/*
+ * MIT License
+ *
+ * Copyright (c) 2018 Igor Konovalov
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	wr "github.com/ikonovalov/global-trade/wrappers"
+	"github.com/shopspring/decimal"
+	"golang.org/x/crypto/ssh/terminal"
+)
+
+// confirmedCommands ask for the confirmation, --timeout applies to every call but not to the question
+var confirmedCommands = map[string]bool{"buy": true, "sell": true, "cancel": true, "oco": true, "twap": true}
+
+type (
+	// orderSafeguards are checks of buy, sell and cancel commands. MaxDeviation is in percents
+	// of the last price, zero disables it.
+	orderSafeguards struct {
+		DryRun       bool
+		Yes          bool
+		MaxDeviation decimal.Decimal
+	}
+
+	// orderPreview is the order about to be placed. Fee is the estimated taker fee in quote currency,
+	// Deviation is the percent of the rate away from the last price.
+	orderPreview struct {
+		Exchange   string
+		Pair       string
+		Side       string
+		Rate       decimal.Decimal
+		Amount     decimal.Decimal
+		Total      decimal.Decimal
+		FeePercent decimal.Decimal
+		Fee        decimal.Decimal
+		Last       decimal.Decimal
+		Deviation  decimal.Decimal
+	}
+)
+
+// previewOrder validates the order against market rules and funds and estimates it with the ticker,
+// the checked market is returned for the further checks without fetching it again
+func previewOrder(ctx context.Context, exchange wr.Exchange, pair string, side string, rate decimal.Decimal, amount decimal.Decimal) (orderPreview, wr.Market, error) {
+	tickersChannel := make(chan wr.TickersResponse, 1)
+	go exchange.GetTickers(ctx, []string{pair}, tickersChannel)
+	market, err := wr.CheckOrder(ctx, exchange.CryptCurrencyExchange, exchange.Name, pair, side, rate, amount)
+	tickers := <-tickersChannel
+	if err != nil {
+		return orderPreview{}, market, err
+	}
+	if tickers.Err != nil {
+		return orderPreview{}, market, tickers.Err
+	}
+
+	total := rate.Mul(amount)
+	rs := orderPreview{
+		Exchange:   exchange.Name,
+		Pair:       pair,
+		Side:       side,
+		Rate:       rate,
+		Amount:     amount,
+		Total:      total,
+		FeePercent: market.Fee,
+		Fee:        total.Mul(market.Fee).Div(hundred),
+		Last:       tickers.Tickers[pair].Last,
+	}
+	if rs.Last.Sign() > 0 {
+		rs.Deviation = percentOf(rate, rs.Last)
+	}
+	return rs, market, nil
+}
+
+// guard refuses orders priced more than maxDeviation percents worse than the last price: buy above it,
+// sell below it. Resting orders on the favorable side can't fill at a worse price.
+func (p orderPreview) guard(maxDeviation decimal.Decimal) error {
+	if maxDeviation.Sign() <= 0 {
+		return nil
+	}
+	if p.Last.Sign() <= 0 {
+		return fmt.Errorf("last price of %s is unknown, the rate can't be checked, use --max-deviation 0 to skip the check", strings.ToUpper(p.Pair))
+	}
+	worse := p.Deviation
+	if p.Side == wr.SideSell {
+		worse = worse.Neg()
+	}
+	if worse.GreaterThan(maxDeviation) {
+		return fmt.Errorf("rate %s is %s away from the last price %s, the limit is %s%%",
+			p.Rate, signedPercent(p.Deviation, "%"), p.Last, maxDeviation)
+	}
+	return nil
+}
+
+// confirm asks the yes/no question on the terminal, anything but y or yes is no
+func confirm(question string) (bool, error) {
+	if !terminal.IsTerminal(int(os.Stdin.Fd())) {
+		return false, fmt.Errorf("confirmation needs a terminal, use --yes in scripts")
+	}
+	fmt.Fprintf(os.Stderr, "%s [y/N]: ", question)
+	answer, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil {
+		return false, err
+	}
+	answer = strings.ToLower(strings.TrimSpace(answer))
+	return answer == "y" || answer == "yes", nil
+}
+
+// placeOrder previews and checks the order, asks for the confirmation and places it
+func placeOrder(ctx context.Context, exchange wr.Exchange, pair string, side string, rate decimal.Decimal, amount decimal.Decimal, safeguards orderSafeguards) {
+	previewCtx, cancel := pollContext(ctx)
+	preview, _, err := previewOrder(previewCtx, exchange, pair, side, rate, amount)
+	cancel()
+	if err != nil {
+		fatal(err)
+	}
+	if err := preview.guard(safeguards.MaxDeviation); err != nil {
+		fatal(err)
+	}
+	if safeguards.DryRun {
+		render(orderPreviewRecords([]orderPreview{preview}), func() {
+			printOrderPreview(preview)
+			fmt.Fprintln(stdout, "Dry run, the order is not placed")
+		})
+		return
+	}
+	if !safeguards.Yes {
+		printTo(os.Stderr, func() { printOrderPreview(preview) })
+		if ok, err := confirm("Place the order?"); err != nil {
+			fatal(err)
+		} else if !ok {
+			fatal("Order is not placed")
+		}
+	}
+
+	ctx, cancel = pollContext(ctx)
+	defer cancel()
+	channel := make(chan wr.PlaceOrderResponse)
+	go exchange.PlaceOrder(ctx, pair, side, rate, amount, channel)
+	rs := <-channel
+	if rs.Err != nil {
+		fatal(rs.Err)
+	}
+	render([]orderResultRecord{{OrderId: rs.Result.OrderId, Received: rs.Result.Received, Remains: rs.Result.Remains}}, func() {
+		printTradeResult(rs.Result)
+	})
+}
+
+// cancelOrder shows the order, asks for the confirmation and cancels it
+func cancelOrder(ctx context.Context, exchange wr.Exchange, orderId string, safeguards orderSafeguards) {
+	if safeguards.DryRun || !safeguards.Yes {
+		infoCtx, cancel := pollContext(ctx)
+		channel := make(chan wr.OrderInfoResponse)
+		go exchange.OrderInfo(infoCtx, orderId, channel)
+		info := <-channel
+		cancel()
+		if info.Err != nil {
+			fatal(info.Err)
+		}
+		if safeguards.DryRun {
+			render(orderRecords([]wr.Order{info.Order}), func() {
+				printOrderInfo(info.Order)
+				fmt.Fprintln(stdout, "Dry run, the order is not cancelled")
+			})
+			return
+		}
+		printTo(os.Stderr, func() { printOrderInfo(info.Order) })
+		if ok, err := confirm("Cancel the order?"); err != nil {
+			fatal(err)
+		} else if !ok {
+			fatal("Order is not cancelled")
+		}
+	}
+
+	result, err := submitCancel(ctx, exchange, orderId)
+	if err != nil {
+		fatal(err)
+	}
+	render([]cancelRecord{{OrderId: result.OrderId}}, func() {
+		fmt.Fprintf(stdout, "Order %s canceled\n", result.OrderId)
+	})
+}
+
+// submitCancel cancels the order on the exchange, --timeout applies to the call
+func submitCancel(ctx context.Context, exchange wr.Exchange, orderId string) (wr.CancelResult, error) {
+	ctx, cancel := pollContext(ctx)
+	defer cancel()
+	channel := make(chan wr.CancelOrderResponse, 1)
+	go exchange.CancelOrder(ctx, orderId, channel)
+	rs := <-channel
+	return rs.Result, rs.Err
+}
@@ -0,0 +1,240 @@
+/*
+ * MIT License
+ *
+ * Copyright (c) 2018 Igor Konovalov
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"github.com/shopspring/decimal"
+	bolt "go.etcd.io/bbolt"
+)
+
+const (
+	snapshotFile = "data/snapshots.db"
+)
+
+var (
+	snapshotsBucket = []byte("snapshots")
+
+	errNoSnapshots = errors.New("no snapshots recorded yet, run wallets or snapshot take")
+)
+
+// portfolioSnapshot is a wallets summary persisted in the snapshots database keyed by Id
+type portfolioSnapshot struct {
+	Id       uint64         `json:"id"`
+	Taken    int64          `json:"taken"`
+	Holdings []walletRecord `json:"holdings"`
+	// Failed lists sources missing in the snapshot
+	Failed []string `json:"failed,omitempty"`
+}
+
+func (s portfolioSnapshot) valueUsd() decimal.Decimal {
+	total := decimal.Zero
+	for _, h := range s.Holdings {
+		total = total.Add(h.VolumeUsd)
+	}
+	return total
+}
+
+func (s portfolioSnapshot) valueBtc() decimal.Decimal {
+	total := decimal.Zero
+	for _, h := range s.Holdings {
+		total = total.Add(h.VolumeBtc)
+	}
+	return total
+}
+
+// openDatabase opens bbolt database file. Missing file is created unless readOnly is set,
+// then os.IsNotExist error is returned.
+func openDatabase(file string, readOnly bool) (*bolt.DB, error) {
+	if readOnly {
+		if _, err := os.Stat(file); err != nil {
+			return nil, err
+		}
+	} else if err := os.MkdirAll(filepath.Dir(file), 0700); err != nil {
+		return nil, err
+	}
+	return bolt.Open(file, 0600, &bolt.Options{Timeout: time.Second * 5, ReadOnly: readOnly})
+}
+
+func snapshotKey(id uint64) []byte {
+	key := make([]byte, 8)
+	binary.BigEndian.PutUint64(key, id)
+	return key
+}
+
+// saveSnapshot records per exchange per coin holdings of the report.
+// Cold wallet address breakdown is skipped, its summary is recorded.
+func saveSnapshot(report walletsReport) (portfolioSnapshot, error) {
+	snapshot := portfolioSnapshot{Taken: time.Now().Unix()}
+	for _, record := range walletRecords(report.Coins, report.Balances, nil, true) {
+		if record.Address == "" {
+			snapshot.Holdings = append(snapshot.Holdings, record)
+		}
+	}
+	for _, err := range report.Errors {
+		snapshot.Failed = append(snapshot.Failed, err.Error())
+	}
+
+	db, err := openDatabase(snapshotFile, false)
+	if err != nil {
+		return snapshot, err
+	}
+	defer db.Close()
+	err = db.Update(func(tx *bolt.Tx) error {
+		bucket, err := tx.CreateBucketIfNotExists(snapshotsBucket)
+		if err != nil {
+			return err
+		}
+		if snapshot.Id, err = bucket.NextSequence(); err != nil {
+			return err
+		}
+		data, err := json.Marshal(snapshot)
+		if err != nil {
+			return err
+		}
+		return bucket.Put(snapshotKey(snapshot.Id), data)
+	})
+	return snapshot, err
+}
+
+// listSnapshots returns all snapshots ordered by id which is the order they were taken
+func listSnapshots() ([]portfolioSnapshot, error) {
+	db, err := openDatabase(snapshotFile, true)
+	if os.IsNotExist(err) {
+		return nil, errNoSnapshots
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+	rs := make([]portfolioSnapshot, 0)
+	err = db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(snapshotsBucket)
+		if bucket == nil {
+			return nil
+		}
+		return bucket.ForEach(func(k, v []byte) error {
+			var snapshot portfolioSnapshot
+			if err := json.Unmarshal(v, &snapshot); err != nil {
+				return fmt.Errorf("snapshot %d: %s", binary.BigEndian.Uint64(k), err)
+			}
+			rs = append(rs, snapshot)
+			return nil
+		})
+	})
+	return rs, err
+}
+
+// findSnapshot resolves the snapshot id, "latest" or a date. A date refers to the last snapshot
+// taken before the end of that day, a date with time refers to the last snapshot taken up to that minute.
+func findSnapshot(ref string) (portfolioSnapshot, error) {
+	snapshots, err := listSnapshots()
+	if err != nil {
+		return portfolioSnapshot{}, err
+	}
+	if len(snapshots) == 0 {
+		return portfolioSnapshot{}, errNoSnapshots
+	}
+	ref = strings.ToLower(strings.TrimSpace(ref))
+	if ref == "latest" {
+		return snapshots[len(snapshots)-1], nil
+	}
+	if id, err := strconv.ParseUint(ref, 10, 64); err == nil {
+		for _, s := range snapshots {
+			if s.Id == id {
+				return s, nil
+			}
+		}
+		return portfolioSnapshot{}, fmt.Errorf("snapshot %d not found", id)
+	}
+
+	var until time.Time
+	if t, err := time.ParseInLocation("2006-01-02t15:04", ref, time.Local); err == nil {
+		until = t.Add(time.Minute)
+	} else if t, err := time.ParseInLocation("2006-01-02", ref, time.Local); err == nil {
+		until = t.AddDate(0, 0, 1)
+	} else {
+		return portfolioSnapshot{}, fmt.Errorf("'%s' is neither snapshot id, date nor latest", ref)
+	}
+	i := sort.Search(len(snapshots), func(i int) bool { return snapshots[i].Taken >= until.Unix() })
+	if i == 0 {
+		return portfolioSnapshot{}, fmt.Errorf("no snapshots taken before %s", until.Format(time.RFC3339))
+	}
+	return snapshots[i-1], nil
+}
+
+// diffSnapshots compares holdings by exchange and coin. Coins present in one snapshot only
+// are compared against zero.
+func diffSnapshots(from, to portfolioSnapshot) []snapshotDiffRecord {
+	type holdingKey struct{ exchange, coin string }
+	index := make(map[holdingKey]*snapshotDiffRecord)
+	rs := make([]*snapshotDiffRecord, 0)
+	lookup := func(h walletRecord) *snapshotDiffRecord {
+		key := holdingKey{h.Exchange, h.Coin}
+		record, ok := index[key]
+		if !ok {
+			record = &snapshotDiffRecord{Exchange: h.Exchange, Coin: h.Coin}
+			index[key] = record
+			rs = append(rs, record)
+		}
+		return record
+	}
+	for _, h := range from.Holdings {
+		record := lookup(h)
+		record.HoldFrom = h.Hold
+		record.ValueUsdFrom = h.VolumeUsd
+		record.ValueBtcFrom = h.VolumeBtc
+	}
+	for _, h := range to.Holdings {
+		record := lookup(h)
+		record.HoldTo = h.Hold
+		record.ValueUsdTo = h.VolumeUsd
+		record.ValueBtcTo = h.VolumeBtc
+	}
+
+	diff := make([]snapshotDiffRecord, 0, len(rs))
+	for _, record := range rs {
+		record.HoldChange = record.HoldTo.Sub(record.HoldFrom)
+		record.ValueUsdChange = record.ValueUsdTo.Sub(record.ValueUsdFrom)
+		record.ValueBtcChange = record.ValueBtcTo.Sub(record.ValueBtcFrom)
+		diff = append(diff, *record)
+	}
+	sort.SliceStable(diff, func(i, j int) bool {
+		if diff[i].Exchange != diff[j].Exchange {
+			return diff[i].Exchange < diff[j].Exchange
+		}
+		return diff[i].Coin < diff[j].Coin
+	})
+	return diff
+}
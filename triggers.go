@@ -0,0 +1,621 @@
+/*
+ * MIT License
+ *
+ * Copyright (c) 2018 Igor Konovalov
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"time"
+	wr "github.com/ikonovalov/global-trade/wrappers"
+	"github.com/shopspring/decimal"
+	bolt "go.etcd.io/bbolt"
+)
+
+const (
+	triggersFile = "data/triggers.db"
+
+	triggerStop         = "stop"
+	triggerTakeProfit   = "take-profit"
+	triggerTrailingStop = "trailing-stop"
+	triggerOco          = "oco"
+
+	crossAbove = "above"
+	crossBelow = "below"
+
+	priceLast = "last"
+	priceBuy  = "buy"
+
+	triggerPending   = "pending"
+	triggerFiring    = "firing"
+	triggerFired     = "fired"
+	triggerFailed    = "failed"
+	triggerCancelled = "cancelled"
+	// triggerFilled is the OCO completed by the fill of its take order
+	triggerFilled = "filled"
+
+	// eventCreated, eventAdjusted and eventResized complement statuses in the trigger event log
+	eventCreated  = "created"
+	eventAdjusted = "adjusted"
+	eventResized  = "resized"
+)
+
+var (
+	triggersBucket      = []byte("triggers")
+	triggerEventsBucket = []byte("trigger_events")
+
+	errTriggerNotPending = errors.New("trigger is not pending")
+)
+
+type (
+	// conditionalOrder is the limit order placed by the daemon when the Source price of the pair
+	// crosses Trigger in Direction. Exchange is the --exchange name of the wrapper.
+	// Trailing stop keeps the best price seen in Extreme, the high for sell and the low for buy,
+	// and moves Trigger Trail (percents of Extreme when TrailPercent is set) behind it. Its Rate is
+	// set when it fires: Offset percents worse than the price, rounded to Precision.
+	// OCO is the stop of the resting TakeOrderId limit order at the Take rate, Amount is the part
+	// of the take order not Filled yet.
+	conditionalOrder struct {
+		Id           uint64          `json:"id"`
+		Kind         string          `json:"kind"`
+		Exchange     string          `json:"exchange"`
+		Pair         string          `json:"pair"`
+		Side         string          `json:"side"`
+		Source       string          `json:"source,omitempty"`
+		Trigger      decimal.Decimal `json:"trigger"`
+		Direction    string          `json:"direction"`
+		Trail        decimal.Decimal `json:"trail"`
+		TrailPercent bool            `json:"trail_percent,omitempty"`
+		Extreme      decimal.Decimal `json:"extreme"`
+		Offset       decimal.Decimal `json:"offset"`
+		Precision    int32           `json:"precision,omitempty"`
+		Take         decimal.Decimal `json:"take"`
+		TakeOrderId  string          `json:"take_order_id,omitempty"`
+		Filled       decimal.Decimal `json:"filled"`
+		Rate         decimal.Decimal `json:"rate"`
+		Amount       decimal.Decimal `json:"amount"`
+		Created      int64           `json:"created"`
+		Status       string          `json:"status"`
+		Updated      int64           `json:"updated,omitempty"`
+		OrderId      string          `json:"order_id,omitempty"`
+		Error        string          `json:"error,omitempty"`
+	}
+
+	// triggerEvent is the event log entry of the trigger: creation, trailing adjustment or status change.
+	// Price is the price observed by the daemon, Level and Extreme are the trigger state after the event.
+	triggerEvent struct {
+		Id      uint64          `json:"id"`
+		Trigger uint64          `json:"trigger"`
+		Time    int64           `json:"time"`
+		Event   string          `json:"event"`
+		Price   decimal.Decimal `json:"price"`
+		Level   decimal.Decimal `json:"level"`
+		Extreme decimal.Decimal `json:"extreme"`
+		Message string          `json:"message,omitempty"`
+	}
+
+	// trailDistance is the trailing stop distance, an amount of quote currency or percents
+	trailDistance struct {
+		Amount  decimal.Decimal
+		Percent bool
+	}
+)
+
+// triggerDirection is the move of the price firing the order. Stop-loss and trailing stop sell
+// when the price falls and buy when it rises, take-profit does the opposite.
+func triggerDirection(kind string, side string) string {
+	if (kind != triggerTakeProfit) == (side == wr.SideSell) {
+		return crossBelow
+	}
+	return crossAbove
+}
+
+// priceTrigger is the stop-loss or take-profit order fired by the last price
+func priceTrigger(exchangeName string, kind string, pair string, side string, trigger decimal.Decimal, rate decimal.Decimal, amount decimal.Decimal) conditionalOrder {
+	return conditionalOrder{
+		Kind:      kind,
+		Exchange:  exchangeName,
+		Pair:      pair,
+		Side:      side,
+		Source:    priceLast,
+		Trigger:   trigger,
+		Direction: triggerDirection(kind, side),
+		Rate:      rate,
+		Amount:    amount,
+	}
+}
+
+// trailingStop is the trailing stop order following the source price, offset is in percents
+func trailingStop(exchangeName string, pair string, side string, trail trailDistance, source string, offset decimal.Decimal, amount decimal.Decimal) conditionalOrder {
+	return conditionalOrder{
+		Kind:         triggerTrailingStop,
+		Exchange:     exchangeName,
+		Pair:         pair,
+		Side:         side,
+		Source:       source,
+		Direction:    triggerDirection(triggerTrailingStop, side),
+		Trail:        trail.Amount,
+		TrailPercent: trail.Percent,
+		Offset:       offset,
+		Amount:       amount,
+	}
+}
+
+// price is the ticker price watched by the trigger
+func (o conditionalOrder) price(ticker wr.Ticker) decimal.Decimal {
+	if o.Source == priceBuy {
+		return ticker.Buy
+	}
+	return ticker.Last
+}
+
+// crossed reports whether the price reached the trigger
+func (o conditionalOrder) crossed(price decimal.Decimal) bool {
+	if price.Sign() <= 0 {
+		return false
+	}
+	if o.Direction == crossBelow {
+		return price.LessThanOrEqual(o.Trigger)
+	}
+	return price.GreaterThanOrEqual(o.Trigger)
+}
+
+// follow moves the trailing stop behind the price when it makes a new high for sell
+// or a new low for buy and reports whether the trigger changed
+func (o *conditionalOrder) follow(price decimal.Decimal) bool {
+	if o.Kind != triggerTrailingStop || price.Sign() <= 0 {
+		return false
+	}
+	if !o.Extreme.IsZero() && (o.Side == wr.SideSell && price.LessThanOrEqual(o.Extreme) ||
+		o.Side == wr.SideBuy && price.GreaterThanOrEqual(o.Extreme)) {
+		return false
+	}
+	o.Extreme = price
+	distance := o.Trail
+	if o.TrailPercent {
+		distance = price.Mul(o.Trail).Div(hundred)
+	}
+	if o.Side == wr.SideSell {
+		o.Trigger = price.Sub(distance)
+	} else {
+		o.Trigger = price.Add(distance)
+	}
+	return true
+}
+
+// limitRate is the rate of the trailing stop fired at the price
+func (o conditionalOrder) limitRate(price decimal.Decimal) decimal.Decimal {
+	offset := price.Mul(o.Offset).Div(hundred)
+	if o.Side == wr.SideSell {
+		return price.Sub(offset).Round(o.Precision)
+	}
+	return price.Add(offset).Round(o.Precision)
+}
+
+// newTrigger validates the order against the market and the current price and stores it pending.
+// Trailing stop starts from the current price, its order is validated at the initial trigger.
+func newTrigger(ctx context.Context, exchange wr.Exchange, o conditionalOrder) (conditionalOrder, error) {
+	tickersChannel := make(chan wr.TickersResponse, 1)
+	go exchange.GetTickers(ctx, []string{o.Pair}, tickersChannel)
+	tickers := <-tickersChannel
+	if tickers.Err != nil {
+		return o, tickers.Err
+	}
+	price := o.price(tickers.Tickers[o.Pair])
+	if price.Sign() <= 0 {
+		return o, fmt.Errorf("no %s price of %s", o.Source, o.Pair)
+	}
+
+	rate := o.Rate
+	if o.Kind == triggerTrailingStop {
+		if o.TrailPercent && o.Trail.GreaterThanOrEqual(hundred) {
+			return o, fmt.Errorf("trail %s%% is not below 100%%", o.Trail)
+		}
+		o.follow(price)
+		rate = o.limitRate(o.Trigger)
+	}
+	if o.Trigger.Sign() <= 0 {
+		return o, fmt.Errorf("trigger %s is not positive", o.Trigger)
+	}
+	if o.Kind != triggerTrailingStop && o.crossed(price) {
+		return o, fmt.Errorf("%s price %s is already %s the trigger %s, place the order with %s", o.Source, price, o.Direction, o.Trigger, o.Side)
+	}
+	market, err := wr.CheckOrder(ctx, exchange.CryptCurrencyExchange, exchange.Name, o.Pair, o.Side, rate, o.Amount)
+	if err != nil {
+		return o, err
+	}
+	o.Precision = market.Precision
+	o.Created = time.Now().Unix()
+	o.Status = triggerPending
+	return o, saveTrigger(&o)
+}
+
+func triggerKey(id uint64) []byte {
+	key := make([]byte, 8)
+	binary.BigEndian.PutUint64(key, id)
+	return key
+}
+
+// saveTrigger stores the new trigger assigning its id
+func saveTrigger(o *conditionalOrder) error {
+	db, err := openDatabase(triggersFile, false)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	return db.Update(func(tx *bolt.Tx) error {
+		bucket, err := tx.CreateBucketIfNotExists(triggersBucket)
+		if err != nil {
+			return err
+		}
+		if o.Id, err = bucket.NextSequence(); err != nil {
+			return err
+		}
+		data, err := json.Marshal(o)
+		if err != nil {
+			return err
+		}
+		if err := bucket.Put(triggerKey(o.Id), data); err != nil {
+			return err
+		}
+		return logTriggerEvent(tx, *o, eventCreated, o.Extreme)
+	})
+}
+
+// logTriggerEvent appends the event of the trigger state o within the transaction
+func logTriggerEvent(tx *bolt.Tx, o conditionalOrder, event string, price decimal.Decimal) error {
+	bucket, err := tx.CreateBucketIfNotExists(triggerEventsBucket)
+	if err != nil {
+		return err
+	}
+	e := triggerEvent{
+		Trigger: o.Id,
+		Time:    time.Now().Unix(),
+		Event:   event,
+		Price:   price,
+		Level:   o.Trigger,
+		Extreme: o.Extreme,
+		Message: o.Error,
+	}
+	switch event {
+	case triggerFired:
+		e.Message = "order " + o.OrderId
+	case triggerFilled:
+		e.Message = "take order " + o.TakeOrderId + " filled"
+	case eventResized:
+		e.Message = fmt.Sprintf("filled %s, stop amount %s", o.Filled, o.Amount)
+	}
+	if e.Id, err = bucket.NextSequence(); err != nil {
+		return err
+	}
+	data, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	return bucket.Put(triggerKey(e.Id), data)
+}
+
+// listTriggers returns pending and firing triggers ordered by id, all of them when all is set
+func listTriggers(all bool) ([]conditionalOrder, error) {
+	db, err := openDatabase(triggersFile, true)
+	if os.IsNotExist(err) {
+		return []conditionalOrder{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+	rs := make([]conditionalOrder, 0)
+	err = db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(triggersBucket)
+		if bucket == nil {
+			return nil
+		}
+		return bucket.ForEach(func(k, v []byte) error {
+			var o conditionalOrder
+			if err := json.Unmarshal(v, &o); err != nil {
+				return fmt.Errorf("trigger %d: %s", binary.BigEndian.Uint64(k), err)
+			}
+			if all || o.Status == triggerPending || o.Status == triggerFiring {
+				rs = append(rs, o)
+			}
+			return nil
+		})
+	})
+	return rs, err
+}
+
+// listTriggerEvents returns the event log in order, events of the trigger only unless id is zero
+func listTriggerEvents(id uint64) ([]triggerEvent, error) {
+	db, err := openDatabase(triggersFile, true)
+	if os.IsNotExist(err) {
+		return []triggerEvent{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+	rs := make([]triggerEvent, 0)
+	err = db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(triggerEventsBucket)
+		if bucket == nil {
+			return nil
+		}
+		return bucket.ForEach(func(k, v []byte) error {
+			var e triggerEvent
+			if err := json.Unmarshal(v, &e); err != nil {
+				return fmt.Errorf("trigger event %d: %s", binary.BigEndian.Uint64(k), err)
+			}
+			if id == 0 || e.Trigger == id {
+				rs = append(rs, e)
+			}
+			return nil
+		})
+	})
+	return rs, err
+}
+
+// updateTrigger changes the stored trigger and logs the event within a single transaction,
+// so the daemon and the cancel command never overwrite each other
+func updateTrigger(id uint64, event string, price decimal.Decimal, update func(o *conditionalOrder) error) (conditionalOrder, error) {
+	var o conditionalOrder
+	db, err := openDatabase(triggersFile, false)
+	if err != nil {
+		return o, err
+	}
+	defer db.Close()
+	err = db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(triggersBucket)
+		if bucket == nil {
+			return fmt.Errorf("trigger %d not found", id)
+		}
+		data := bucket.Get(triggerKey(id))
+		if data == nil {
+			return fmt.Errorf("trigger %d not found", id)
+		}
+		if err := json.Unmarshal(data, &o); err != nil {
+			return err
+		}
+		if err := update(&o); err != nil {
+			return err
+		}
+		o.Updated = time.Now().Unix()
+		if data, err = json.Marshal(o); err != nil {
+			return err
+		}
+		if err := bucket.Put(triggerKey(id), data); err != nil {
+			return err
+		}
+		return logTriggerEvent(tx, o, event, price)
+	})
+	return o, err
+}
+
+func cancelTrigger(id uint64) (conditionalOrder, error) {
+	return updateTrigger(id, triggerCancelled, decimal.Zero, func(o *conditionalOrder) error {
+		if o.Status != triggerPending {
+			return fmt.Errorf("trigger %d is %s, only pending triggers can be cancelled", id, o.Status)
+		}
+		o.Status = triggerCancelled
+		return nil
+	})
+}
+
+// runDaemon polls tickers of pending triggers every interval and fires crossed ones until ctx is cancelled.
+// Triggers left firing by the stopped daemon are failed, the order may have been placed.
+func runDaemon(ctx context.Context, exchanges map[string]wr.Exchange, interval time.Duration) error {
+	triggers, err := listTriggers(false)
+	if err != nil {
+		return err
+	}
+	for _, o := range triggers {
+		if o.Status != triggerFiring {
+			continue
+		}
+		o, err = updateTrigger(o.Id, triggerFailed, decimal.Zero, func(o *conditionalOrder) error {
+			o.Status = triggerFailed
+			o.Error = "daemon stopped while placing the order, check open orders"
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		printTriggerEvent(o, triggerFailed, decimal.Zero)
+	}
+
+	fmt.Fprintf(stdout, "%s daemon started, polling every %s\n", time.Now().Format(time.Stamp), interval)
+	for {
+		if err := pollTriggers(ctx, exchanges); err != nil {
+			fmt.Fprintf(stdout, "%s %s\n", time.Now().Format(time.Stamp), err)
+		}
+		select {
+		case <-time.After(interval):
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
+
+// pollTriggers fetches tickers of pending triggers once per exchange, moves trailing stops
+// and fires crossed triggers
+func pollTriggers(ctx context.Context, exchanges map[string]wr.Exchange) error {
+	triggers, err := listTriggers(false)
+	if err != nil {
+		return err
+	}
+	byExchange := make(map[string][]conditionalOrder)
+	for _, o := range triggers {
+		if o.Status == triggerPending {
+			byExchange[o.Exchange] = append(byExchange[o.Exchange], o)
+		}
+	}
+	names := make([]string, 0, len(byExchange))
+	for name := range byExchange {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var errs []string
+	for _, name := range names {
+		exchange, ok := exchanges[name]
+		if !ok {
+			errs = append(errs, fmt.Sprintf("unknown exchange %s", name))
+			continue
+		}
+		pairs := make([]string, 0)
+		seen := make(map[string]bool)
+		for _, o := range byExchange[name] {
+			if !seen[o.Pair] {
+				seen[o.Pair] = true
+				pairs = append(pairs, o.Pair)
+			}
+		}
+		pollCtx, cancel := pollContext(ctx)
+		channel := make(chan wr.TickersResponse, 1)
+		go exchange.GetTickers(pollCtx, pairs, channel)
+		tickers := <-channel
+		cancel()
+		if tickers.Err != nil {
+			errs = append(errs, tickers.Err.Error())
+			continue
+		}
+		open, err := openOcoOrders(ctx, exchange, byExchange[name])
+		if err != nil {
+			errs = append(errs, err.Error())
+		}
+		for _, o := range byExchange[name] {
+			if o.Kind == triggerOco {
+				// the stop can't fire while the state of the take order is unknown
+				if open == nil {
+					continue
+				}
+				tracked, done, err := trackOco(ctx, exchange, o, open)
+				if err != nil {
+					errs = append(errs, fmt.Sprintf("trigger %d: %s", o.Id, err))
+					continue
+				}
+				if done {
+					continue
+				}
+				o = tracked
+			}
+			price := o.price(tickers.Tickers[o.Pair])
+			if moved := o; moved.follow(price) {
+				adjusted, err := adjustTrigger(o.Id, price)
+				if err != nil {
+					if err != errTriggerNotPending {
+						errs = append(errs, fmt.Sprintf("trigger %d: %s", o.Id, err))
+					}
+					continue
+				}
+				o = adjusted
+				printTriggerEvent(o, eventAdjusted, price)
+			}
+			if o.crossed(price) {
+				fireTrigger(ctx, exchange, o, price)
+			}
+		}
+	}
+	if len(errs) > 0 {
+		return errors.New(strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// adjustTrigger stores the trailing stop moved by the price
+func adjustTrigger(id uint64, price decimal.Decimal) (conditionalOrder, error) {
+	return updateTrigger(id, eventAdjusted, price, func(o *conditionalOrder) error {
+		if o.Status != triggerPending {
+			return errTriggerNotPending
+		}
+		o.follow(price)
+		return nil
+	})
+}
+
+// fireTrigger places the order of the crossed trigger. The trigger is marked firing first,
+// so it's never placed twice and cancelled meanwhile trigger is skipped.
+func fireTrigger(ctx context.Context, exchange wr.Exchange, o conditionalOrder, price decimal.Decimal) {
+	firing, err := updateTrigger(o.Id, triggerFiring, price, func(o *conditionalOrder) error {
+		if o.Status != triggerPending {
+			return errTriggerNotPending
+		}
+		o.Status = triggerFiring
+		if o.Kind == triggerTrailingStop {
+			o.Rate = o.limitRate(price)
+		}
+		return nil
+	})
+	if err != nil {
+		if err != errTriggerNotPending {
+			fmt.Fprintf(stdout, "%s trigger %d: %s\n", time.Now().Format(time.Stamp), o.Id, err)
+		}
+		return
+	}
+
+	// OCO cancels the take order first, the stop covers whatever is left of it
+	amount := firing.Amount
+	var rs wr.PlaceOrderResponse
+	if firing.Kind == triggerOco {
+		amount, rs.Err = cancelTakeOrder(ctx, exchange, firing)
+	}
+	if rs.Err == nil && amount.Sign() > 0 {
+		pollCtx, cancel := pollContext(ctx)
+		channel := make(chan wr.PlaceOrderResponse, 1)
+		go exchange.PlaceOrder(pollCtx, firing.Pair, firing.Side, firing.Rate, amount, channel)
+		rs = <-channel
+		cancel()
+	}
+
+	status := triggerFired
+	if rs.Err != nil {
+		status = triggerFailed
+	} else if amount.Sign() <= 0 {
+		status = triggerFilled
+	}
+	fired, err := updateTrigger(o.Id, status, price, func(o *conditionalOrder) error {
+		o.Status = status
+		if o.Kind == triggerOco && rs.Err == nil {
+			o.Filled = o.Filled.Add(o.Amount).Sub(amount)
+			o.Amount = amount
+		}
+		if rs.Err != nil {
+			o.Error = rs.Err.Error()
+		} else {
+			o.OrderId = rs.Result.OrderId
+		}
+		return nil
+	})
+	if err != nil {
+		fmt.Fprintf(stdout, "%s trigger %d: %s\n", time.Now().Format(time.Stamp), o.Id, err)
+		return
+	}
+	printTriggerEvent(fired, status, price)
+}
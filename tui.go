@@ -0,0 +1,595 @@
+/*
+ * MIT License
+ *
+ * Copyright (c) 2018 Igor Konovalov
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+	wr "github.com/ikonovalov/global-trade/wrappers"
+	"github.com/jroimartin/gocui"
+	. "github.com/logrusorgru/aurora"
+	"github.com/shopspring/decimal"
+	"golang.org/x/crypto/ssh/terminal"
+)
+
+// Views of the terminal UI
+const (
+	tuiTickers = "tickers"
+	tuiTicker  = "ticker"
+	tuiBook    = "book"
+	tuiTrades  = "trades"
+	tuiOrders  = "orders"
+	tuiWallets = "wallets"
+	tuiStatus  = "status"
+	tuiPrompt  = "prompt"
+	tuiConfirm = "confirm"
+
+	// tuiMarketCalls is the number of exchange calls of the single market refresh
+	tuiMarketCalls = 4
+	tuiBookLimit   = 50
+	tuiTradesLimit = 50
+	tuiHelp        = "↑↓ pair  tab orders  b buy  s sell  c cancel  r refresh  q quit"
+)
+
+type (
+	// tui is the full screen cockpit of the exchange. Market data of the selected pair is
+	// refreshed in the background, the fields below mu are accessed in the gui main loop only.
+	tui struct {
+		g          *gocui.Gui
+		exchange   wr.Exchange
+		exchanges  []wr.Exchange
+		credential GlobalCredentials
+		pairs      []string
+		interval   time.Duration
+		refresh    chan struct{}
+
+		mu       sync.Mutex
+		selected int
+
+		tickers     map[string]wr.Ticker
+		marketPair  string
+		book        wr.OrderBook
+		trades      []wr.Trade
+		orders      []wr.Order
+		orderCursor int
+		wallets     *walletsReport
+		focus       string
+		status      string
+		prompt      *tuiOrderPrompt
+		confirm     *tuiConfirmation
+	}
+
+	// tuiOrderPrompt asks the rate and the amount of the new order
+	tuiOrderPrompt struct {
+		Side    string
+		Pair    string
+		Initial string
+	}
+
+	// tuiConfirmation asks yes or no before the action
+	tuiConfirmation struct {
+		Message string
+		Action  func()
+	}
+)
+
+// runTui shows the terminal UI of the exchange until quit. Pairs are shown in the ticker list,
+// interval is the market data refresh period.
+func runTui(ctx context.Context, exchange wr.Exchange, exchanges []wr.Exchange, credential GlobalCredentials, pairs []string, interval time.Duration) error {
+	if !terminal.IsTerminal(int(os.Stdout.Fd())) {
+		return fmt.Errorf("tui needs a terminal")
+	}
+	g, err := gocui.NewGui(gocui.OutputNormal)
+	if err != nil {
+		return err
+	}
+	defer g.Close()
+	g.InputEsc = true
+	g.SelFgColor = gocui.ColorGreen
+
+	t := &tui{
+		g:          g,
+		exchange:   exchange,
+		exchanges:  exchanges,
+		credential: credential,
+		pairs:      pairs,
+		interval:   interval,
+		refresh:    make(chan struct{}, 1),
+		tickers:    make(map[string]wr.Ticker),
+		focus:      tuiTickers,
+		status:     "Loading...",
+	}
+	g.SetManagerFunc(t.layout)
+	if err := t.bindKeys(); err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go t.marketLoop(ctx)
+	go t.walletsLoop(ctx)
+	go func() {
+		<-ctx.Done()
+		g.Update(func(g *gocui.Gui) error { return gocui.ErrQuit })
+	}()
+
+	if err := g.MainLoop(); err != nil && err != gocui.ErrQuit {
+		return err
+	}
+	return nil
+}
+
+func (t *tui) selectedPair() string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.pairs[t.selected]
+}
+
+func (t *tui) selectPair(shift int) {
+	t.mu.Lock()
+	t.selected = (t.selected + shift + len(t.pairs)) % len(t.pairs)
+	t.mu.Unlock()
+	t.orderCursor = 0
+	t.requestRefresh()
+}
+
+func (t *tui) requestRefresh() {
+	select {
+	case t.refresh <- struct{}{}:
+	default:
+	}
+}
+
+// marketLoop refreshes tickers of all pairs, order book, trades and open orders of the selected pair
+func (t *tui) marketLoop(ctx context.Context) {
+	for {
+		t.refreshMarket(ctx)
+		select {
+		case <-time.After(t.interval):
+		case <-t.refresh:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (t *tui) refreshMarket(ctx context.Context) {
+	pollCtx, cancel := pollContext(ctx)
+	defer cancel()
+	pair := t.selectedPair()
+
+	tickersChannel := make(chan wr.TickersResponse, 1)
+	bookChannel := make(chan wr.OrderBookResponse, 1)
+	tradesChannel := make(chan wr.TradesResponse, 1)
+	ordersChannel := make(chan wr.OrdersResponse, 1)
+	go t.exchange.GetTickers(pollCtx, t.pairs, tickersChannel)
+	go t.exchange.OrderBook(pollCtx, pair, tuiBookLimit, bookChannel)
+	go t.exchange.Trades(pollCtx, pair, tuiTradesLimit, tradesChannel)
+	go t.exchange.OpenOrders(pollCtx, pair, ordersChannel)
+	tickers, book, trades, orders := <-tickersChannel, <-bookChannel, <-tradesChannel, <-ordersChannel
+
+	t.g.Update(func(g *gocui.Gui) error {
+		var errs []string
+		if tickers.Err == nil {
+			for p, ticker := range tickers.Tickers {
+				t.tickers[p] = ticker
+			}
+		} else {
+			errs = append(errs, tickers.Err.Error())
+		}
+		if pair != t.marketPair {
+			t.book, t.trades, t.orders = wr.OrderBook{}, nil, nil
+			t.marketPair = pair
+		}
+		if book.Err == nil {
+			t.book = book.OrderBook
+		} else {
+			errs = append(errs, book.Err.Error())
+		}
+		if trades.Err == nil {
+			t.trades = trades.Trades
+		} else {
+			errs = append(errs, trades.Err.Error())
+		}
+		if orders.Err == nil {
+			t.orders = orders.Orders
+		} else {
+			errs = append(errs, orders.Err.Error())
+		}
+		if len(errs) > 0 {
+			t.status = Red(strings.Join(errs, "; ")).String()
+		} else {
+			t.status = "Updated " + time.Now().Format("15:04:05")
+		}
+		return nil
+	})
+}
+
+// walletsLoop refreshes wallet totals, sources are rate limited more than the exchange
+func (t *tui) walletsLoop(ctx context.Context) {
+	interval := watchInterval(t.interval, walletsPollInterval(t.credential, t.exchanges)...)
+	for {
+		pollCtx, cancel := pollContext(ctx)
+		report := fetchWallets(pollCtx, t.credential, t.exchanges, false)
+		cancel()
+		t.g.Update(func(g *gocui.Gui) error {
+			t.wallets = &report
+			return nil
+		})
+		select {
+		case <-time.After(interval):
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// layout places views and redraws their content, it is called by gocui on every event
+func (t *tui) layout(g *gocui.Gui) error {
+	maxX, maxY := g.Size()
+	left := maxX / 4
+	top := (maxY - 1) * 55 / 100
+	tradesRight := left + (maxX-left)*45/100
+	ordersBottom := top + (maxY-1-top)/2
+
+	panes := []struct {
+		name           string
+		title          string
+		x0, y0, x1, y1 int
+		draw           func(v *gocui.View)
+	}{
+		{tuiTickers, "Tickers " + t.exchange.Name, 0, 0, left - 1, top - 1, t.drawTickers},
+		{tuiBook, "Order book", left, 0, maxX - 1, top - 1, t.drawBook},
+		{tuiTicker, "24h", 0, top, left - 1, maxY - 2, t.drawTicker},
+		{tuiTrades, "Trades", left, top, tradesRight - 1, maxY - 2, t.drawTrades},
+		{tuiOrders, "Open orders", tradesRight, top, maxX - 1, ordersBottom - 1, t.drawOrders},
+		{tuiWallets, "Wallets", tradesRight, ordersBottom, maxX - 1, maxY - 2, t.drawWallets},
+	}
+	for _, p := range panes {
+		v, err := g.SetView(p.name, p.x0, p.y0, p.x1, p.y1)
+		if err != nil && err != gocui.ErrUnknownView {
+			return err
+		}
+		v.Title = p.title
+		v.Clear()
+		p.draw(v)
+	}
+
+	status, err := g.SetView(tuiStatus, -1, maxY-2, maxX, maxY)
+	if err != nil && err != gocui.ErrUnknownView {
+		return err
+	}
+	status.Frame = false
+	status.Clear()
+	fmt.Fprintf(status, "%s  %s", Bold(tuiHelp), t.status)
+
+	if err := t.layoutDialogs(g, maxX, maxY); err != nil {
+		return err
+	}
+	if t.prompt == nil && t.confirm == nil {
+		if _, err := g.SetCurrentView(t.focus); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (t *tui) layoutDialogs(g *gocui.Gui, maxX, maxY int) error {
+	if t.prompt != nil {
+		v, err := g.SetView(tuiPrompt, maxX/4, maxY/2-1, maxX*3/4, maxY/2+1)
+		if err == gocui.ErrUnknownView {
+			v.Title = fmt.Sprintf("%s %s on %s: rate amount, Enter to continue, Esc to close",
+				strings.ToUpper(t.prompt.Side), strings.ToUpper(t.prompt.Pair), t.exchange.Name)
+			v.Editable = true
+			fmt.Fprint(v, t.prompt.Initial)
+			v.SetCursor(len(t.prompt.Initial), 0)
+			if _, err := g.SetCurrentView(tuiPrompt); err != nil {
+				return err
+			}
+		} else if err != nil {
+			return err
+		}
+	} else if err := g.DeleteView(tuiPrompt); err != nil && err != gocui.ErrUnknownView {
+		return err
+	}
+
+	if t.confirm != nil {
+		v, err := g.SetView(tuiConfirm, maxX/4, maxY/2-2, maxX*3/4, maxY/2+2)
+		if err == gocui.ErrUnknownView {
+			v.Title = "Confirm: y yes, n no"
+			v.Wrap = true
+			fmt.Fprint(v, t.confirm.Message)
+			if _, err := g.SetCurrentView(tuiConfirm); err != nil {
+				return err
+			}
+		} else if err != nil {
+			return err
+		}
+	} else if err := g.DeleteView(tuiConfirm); err != nil && err != gocui.ErrUnknownView {
+		return err
+	}
+	return nil
+}
+
+// printTo redirects printers into the view
+func printTo(v io.Writer, printer func()) {
+	out := stdout
+	stdout = v
+	printer()
+	stdout = out
+}
+
+func (t *tui) drawTickers(v *gocui.View) {
+	v.Highlight = t.focus == tuiTickers
+	for _, pair := range t.pairs {
+		ticker, ok := t.tickers[pair]
+		if !ok {
+			fmt.Fprintf(v, "%-10s\n", strings.ToUpper(pair))
+			continue
+		}
+		fmt.Fprintf(v, "%-10s %s %s\n", strings.ToUpper(pair), sprintDecimal(ticker.Last), sprintTickerChange(ticker))
+	}
+	v.SetCursor(0, t.selected)
+}
+
+func (t *tui) drawTicker(v *gocui.View) {
+	pair := t.pairs[t.selected]
+	if ticker, ok := t.tickers[pair]; ok {
+		printTo(v, func() { printTicker(ticker, strings.ToUpper(pair)) })
+	}
+}
+
+func (t *tui) drawBook(v *gocui.View) {
+	if t.marketPair != t.pairs[t.selected] {
+		return
+	}
+	v.Title = "Order book " + strings.ToUpper(t.marketPair)
+	printTo(v, func() { printOffers(t.book, wallSettings{Sensitivity: 2}, decimal.Zero) })
+}
+
+func (t *tui) drawTrades(v *gocui.View) {
+	if t.marketPair != t.pairs[t.selected] {
+		return
+	}
+	printTo(v, func() { printTrades(t.trades) })
+}
+
+func (t *tui) drawOrders(v *gocui.View) {
+	v.Highlight = t.focus == tuiOrders
+	if t.marketPair != t.pairs[t.selected] {
+		return
+	}
+	printTo(v, func() { printActiveOrders(t.orders) })
+	if t.orderCursor >= len(t.orders) {
+		t.orderCursor = len(t.orders) - 1
+	}
+	if t.orderCursor < 0 {
+		t.orderCursor = 0
+	}
+	v.SetCursor(0, t.orderCursor)
+}
+
+func (t *tui) drawWallets(v *gocui.View) {
+	if t.wallets == nil {
+		fmt.Fprintln(v, "Loading...")
+		return
+	}
+	snapshot := portfolioSnapshot{Holdings: walletRecords(t.wallets.Coins, t.wallets.Balances, nil, true)}
+	fmt.Fprintf(v, "%s %s USD  %s BTC\n", Bold("Total"), snapshot.valueUsd().StringFixed(2), sprintDecimal(snapshot.valueBtc()))
+
+	pair, err := wr.ParsePair(t.pairs[t.selected])
+	for _, b := range t.wallets.Balances {
+		if b.Exchange.Name == t.exchange.Name && err == nil {
+			fmt.Fprintf(v, "%s available: %s %s  %s %s\n", b.Exchange.Name,
+				sprintDecimal(b.AvailableFunds[pair.Base]), pair.Base, sprintDecimal(b.AvailableFunds[pair.Quote]), pair.Quote)
+		}
+	}
+	for _, err := range t.wallets.Errors {
+		fmt.Fprintln(v, Red(err.Error()))
+	}
+}
+
+func (t *tui) bindKeys() error {
+	type binding struct {
+		views   []string
+		key     interface{}
+		handler func(g *gocui.Gui, v *gocui.View) error
+	}
+	panes := []string{tuiTickers, tuiOrders}
+	bindings := []binding{
+		{[]string{""}, gocui.KeyCtrlC, t.quit},
+		{panes, 'q', t.quit},
+		{panes, 'r', func(g *gocui.Gui, v *gocui.View) error { t.requestRefresh(); return nil }},
+		{panes, gocui.KeyTab, t.switchFocus},
+		{panes, 'b', func(g *gocui.Gui, v *gocui.View) error { return t.openPrompt(wr.SideBuy) }},
+		{panes, 's', func(g *gocui.Gui, v *gocui.View) error { return t.openPrompt(wr.SideSell) }},
+		{panes, gocui.KeyArrowUp, t.cursorUp},
+		{panes, 'k', t.cursorUp},
+		{panes, gocui.KeyArrowDown, t.cursorDown},
+		{panes, 'j', t.cursorDown},
+		{[]string{tuiOrders}, 'c', t.confirmCancel},
+		{[]string{tuiPrompt}, gocui.KeyEnter, t.submitPrompt},
+		{[]string{tuiPrompt}, gocui.KeyEsc, t.closeDialogs},
+		{[]string{tuiConfirm}, 'y', t.acceptConfirmation},
+		{[]string{tuiConfirm}, 'n', t.closeDialogs},
+		{[]string{tuiConfirm}, gocui.KeyEsc, t.closeDialogs},
+	}
+	for _, b := range bindings {
+		for _, view := range b.views {
+			if err := t.g.SetKeybinding(view, b.key, gocui.ModNone, b.handler); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (t *tui) quit(g *gocui.Gui, v *gocui.View) error {
+	return gocui.ErrQuit
+}
+
+func (t *tui) switchFocus(g *gocui.Gui, v *gocui.View) error {
+	if t.focus == tuiTickers {
+		t.focus = tuiOrders
+	} else {
+		t.focus = tuiTickers
+	}
+	return nil
+}
+
+func (t *tui) cursorUp(g *gocui.Gui, v *gocui.View) error {
+	if t.focus == tuiOrders {
+		if t.orderCursor > 0 {
+			t.orderCursor--
+		}
+		return nil
+	}
+	t.selectPair(-1)
+	return nil
+}
+
+func (t *tui) cursorDown(g *gocui.Gui, v *gocui.View) error {
+	if t.focus == tuiOrders {
+		if t.orderCursor < len(t.orders)-1 {
+			t.orderCursor++
+		}
+		return nil
+	}
+	t.selectPair(1)
+	return nil
+}
+
+// openPrompt starts the new order dialog with the best opposite price as the rate
+func (t *tui) openPrompt(side string) error {
+	pair := t.pairs[t.selected]
+	initial := ""
+	if t.marketPair == pair {
+		levels := t.book.Asks
+		if side == wr.SideSell {
+			levels = t.book.Bids
+		}
+		if len(levels) > 0 {
+			initial = levels[0].Price.String() + " "
+		}
+	}
+	t.prompt = &tuiOrderPrompt{Side: side, Pair: pair, Initial: initial}
+	return nil
+}
+
+func (t *tui) submitPrompt(g *gocui.Gui, v *gocui.View) error {
+	prompt := *t.prompt
+	fields := strings.Fields(v.Buffer())
+	if len(fields) != 2 {
+		t.status = Red("Enter the rate and the amount separated by space").String()
+		return nil
+	}
+	rate, rateErr := decimal.NewFromString(fields[0])
+	amount, amountErr := decimal.NewFromString(fields[1])
+	if rateErr != nil || amountErr != nil || rate.Sign() <= 0 || amount.Sign() <= 0 {
+		t.status = Red(fmt.Sprintf("'%s' is not a positive rate and amount", strings.Join(fields, " "))).String()
+		return nil
+	}
+	pair, _ := wr.ParsePair(prompt.Pair)
+	t.prompt = nil
+	t.confirm = &tuiConfirmation{
+		Message: fmt.Sprintf("%s %s %s at %s %s (total %s %s) on %s?",
+			strings.ToUpper(prompt.Side), amount, pair.Base, rate, pair.Quote, amount.Mul(rate), pair.Quote, t.exchange.Name),
+		Action: func() { t.placeOrder(prompt.Pair, prompt.Side, rate, amount) },
+	}
+	return nil
+}
+
+func (t *tui) confirmCancel(g *gocui.Gui, v *gocui.View) error {
+	if t.orderCursor >= len(t.orders) {
+		return nil
+	}
+	order := t.orders[t.orderCursor]
+	t.confirm = &tuiConfirmation{
+		Message: fmt.Sprintf("Cancel %s %s order %s, amount %s at %s on %s?",
+			strings.ToUpper(order.Side), strings.ToUpper(order.Pair), order.Id, order.Amount, order.Rate, t.exchange.Name),
+		Action: func() { t.cancelOrder(order.Id) },
+	}
+	return nil
+}
+
+func (t *tui) acceptConfirmation(g *gocui.Gui, v *gocui.View) error {
+	action := t.confirm.Action
+	t.confirm = nil
+	action()
+	return nil
+}
+
+func (t *tui) closeDialogs(g *gocui.Gui, v *gocui.View) error {
+	t.prompt, t.confirm = nil, nil
+	return nil
+}
+
+func (t *tui) placeOrder(pair string, side string, rate decimal.Decimal, amount decimal.Decimal) {
+	t.status = fmt.Sprintf("Placing %s order...", side)
+	go func() {
+		ctx, cancel := pollContext(context.Background())
+		defer cancel()
+		var rs wr.PlaceOrderResponse
+		if _, rs.Err = wr.CheckOrder(ctx, t.exchange.CryptCurrencyExchange, t.exchange.Name, pair, side, rate, amount); rs.Err == nil {
+			channel := make(chan wr.PlaceOrderResponse, 1)
+			go t.exchange.PlaceOrder(ctx, pair, side, rate, amount, channel)
+			rs = <-channel
+		}
+		t.g.Update(func(g *gocui.Gui) error {
+			if rs.Err != nil {
+				t.status = Red(rs.Err.Error()).String()
+			} else {
+				t.status = Green(fmt.Sprintf("Order %s placed, received %s, remains %s", rs.Result.OrderId, rs.Result.Received, rs.Result.Remains)).String()
+			}
+			t.requestRefresh()
+			return nil
+		})
+	}()
+}
+
+func (t *tui) cancelOrder(orderId string) {
+	t.status = fmt.Sprintf("Cancelling order %s...", orderId)
+	go func() {
+		ctx, cancel := pollContext(context.Background())
+		defer cancel()
+		channel := make(chan wr.CancelOrderResponse, 1)
+		go t.exchange.CancelOrder(ctx, orderId, channel)
+		rs := <-channel
+		t.g.Update(func(g *gocui.Gui) error {
+			if rs.Err != nil {
+				t.status = Red(rs.Err.Error()).String()
+			} else {
+				t.status = Green(fmt.Sprintf("Order %s cancelled", rs.Result.OrderId)).String()
+			}
+			t.requestRefresh()
+			return nil
+		})
+	}()
+}
@@ -0,0 +1,345 @@
+/*
+ * MIT License
+ *
+ * Copyright (c) 2018 Igor Konovalov
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+	wr "github.com/ikonovalov/global-trade/wrappers"
+	. "github.com/logrusorgru/aurora"
+	"github.com/shopspring/decimal"
+)
+
+const (
+	// twapPollInterval is the interval of child order fill checks, raised by the exchange rate limit
+	twapPollInterval = 10 * time.Second
+	// twapAmountPlaces is the number of decimal places of child order amounts
+	twapAmountPlaces = 8
+)
+
+type (
+	// twapPlan splits the parent order into Slices child limit orders evenly over Duration.
+	// Child orders never cross Limit, Visible limits the size of a single child, zero shows the whole slice.
+	twapPlan struct {
+		Pair     string
+		Side     string
+		Total    decimal.Decimal
+		Limit    decimal.Decimal
+		Duration time.Duration
+		Slices   int
+		Visible  decimal.Decimal
+	}
+
+	// twapChild is the child order of the slice, Filled is known once it's closed or cancelled
+	twapChild struct {
+		Slice   int
+		OrderId string
+		Rate    decimal.Decimal
+		Amount  decimal.Decimal
+		Filled  decimal.Decimal
+	}
+
+	// twapReport is the fill summary of the parent order. Slippage is the percent of AveragePrice
+	// worse than ArrivalPrice, the last price at the start.
+	twapReport struct {
+		Exchange     string
+		Pair         string
+		Side         string
+		Total        decimal.Decimal
+		Filled       decimal.Decimal
+		AveragePrice decimal.Decimal
+		ArrivalPrice decimal.Decimal
+		Slippage     decimal.Decimal
+		Children     []twapChild
+		Started      int64
+		Finished     int64
+		Interrupted  bool
+	}
+
+	// twapExecution is the running parent order
+	twapExecution struct {
+		exchange     wr.Exchange
+		plan         twapPlan
+		market       wr.Market
+		pollInterval time.Duration
+		report       twapReport
+	}
+)
+
+// scheduled is the parent amount due by the end of the slice
+func (p twapPlan) scheduled(slice int) decimal.Decimal {
+	if slice >= p.Slices-1 {
+		return p.Total
+	}
+	return p.Total.Mul(decimal.New(int64(slice+1), 0)).Div(decimal.New(int64(p.Slices), 0)).Truncate(twapAmountPlaces)
+}
+
+// childRate is the best price on the other side of the book bounded by the limit,
+// the child order rests at the limit when the book is beyond it
+func (p twapPlan) childRate(ticker wr.Ticker, precision int32) decimal.Decimal {
+	if p.Side == wr.SideSell {
+		if ticker.Buy.GreaterThan(p.Limit) {
+			return ticker.Buy.Round(precision)
+		}
+		return p.Limit
+	}
+	if ticker.Sell.Sign() > 0 && ticker.Sell.LessThan(p.Limit) {
+		return ticker.Sell.Round(precision)
+	}
+	return p.Limit
+}
+
+// runTwap checks the plan, asks for the confirmation and executes the parent order until it's
+// filled, the duration is over or ctx is cancelled, then renders the fill summary
+func runTwap(ctx context.Context, exchange wr.Exchange, plan twapPlan, safeguards orderSafeguards) {
+	if plan.Slices <= 0 || plan.Duration <= 0 {
+		fatal("slices and duration must be positive")
+	}
+	if plan.Limit.Sign() <= 0 {
+		fatal(fmt.Errorf("limit %s is not positive", plan.Limit))
+	}
+	checkCtx, cancel := pollContext(ctx)
+	preview, market, err := previewOrder(checkCtx, exchange, plan.Pair, plan.Side, plan.Limit, plan.Total)
+	cancel()
+	if err != nil {
+		fatal(err)
+	}
+	if slice := plan.scheduled(0); slice.LessThan(market.MinAmount) {
+		fatal(fmt.Errorf("slice %s is below the minimal amount %s, use fewer slices", slice, market.MinAmount))
+	}
+	if plan.Visible.Sign() > 0 && plan.Visible.LessThan(market.MinAmount) {
+		fatal(fmt.Errorf("visible amount %s is below the minimal amount %s", plan.Visible, market.MinAmount))
+	}
+
+	printPlan := func() {
+		printOrderPreview(preview)
+		printTwapPlan(plan)
+	}
+	if safeguards.DryRun {
+		render(orderPreviewRecords([]orderPreview{preview}), func() {
+			printPlan()
+			fmt.Fprintln(stdout, "Dry run, the order is not placed")
+		})
+		return
+	}
+	if !safeguards.Yes {
+		printTo(os.Stderr, printPlan)
+		if ok, err := confirm("Start the execution?"); err != nil {
+			fatal(err)
+		} else if !ok {
+			fatal("Order is not placed")
+		}
+	}
+
+	e := &twapExecution{
+		exchange:     exchange,
+		plan:         plan,
+		market:       market,
+		pollInterval: watchInterval(twapPollInterval, exchange.PollInterval*2),
+		report: twapReport{
+			Exchange:     exchange.Name,
+			Pair:         plan.Pair,
+			Side:         plan.Side,
+			Total:        plan.Total,
+			ArrivalPrice: preview.Last,
+			Started:      time.Now().Unix(),
+		},
+	}
+	err = e.run(ctx)
+	e.report.Finished = time.Now().Unix()
+	e.report.Interrupted = ctx.Err() != nil
+	e.report.summarize()
+
+	render(twapRecords([]twapReport{e.report}), func() {
+		printTwapReport(e.report)
+	})
+	if err != nil {
+		fatal(err)
+	}
+}
+
+// run places child orders slice by slice, a slice gets whatever is left unfilled of the previous ones.
+// The error is returned when the state of a placed child order is unknown.
+func (e *twapExecution) run(ctx context.Context) error {
+	start := time.Now()
+	interval := e.plan.Duration / time.Duration(e.plan.Slices)
+	for slice := 0; slice < e.plan.Slices; slice++ {
+		end := start.Add(interval * time.Duration(slice+1))
+		for ctx.Err() == nil {
+			due := e.plan.scheduled(slice).Sub(e.report.Filled).Truncate(twapAmountPlaces)
+			if due.LessThan(e.market.MinAmount) || due.Sign() <= 0 || !time.Now().Before(end) {
+				break
+			}
+			amount := due
+			if e.plan.Visible.Sign() > 0 && amount.GreaterThan(e.plan.Visible) {
+				amount = e.plan.Visible
+			}
+			child, err := e.place(ctx, slice, amount)
+			if wr.IsOrderOutcomeUnknown(err) {
+				// the child may be on the book, executing further slices could oversell the parent
+				return err
+			}
+			if err != nil {
+				// nothing is placed, the amount goes to the next slice
+				fmt.Fprintf(os.Stderr, "%s slice %d/%d: %s\n", time.Now().Format(time.Stamp), slice+1, e.plan.Slices, Red(err))
+				break
+			}
+			if err := e.follow(ctx, &child, end); err != nil {
+				return fmt.Errorf("order %s: %s", child.OrderId, err)
+			}
+			if child.Filled.LessThan(child.Amount) {
+				// the slice window is over, the rest goes to the next slice
+				break
+			}
+		}
+		if err := sleepUntil(ctx, end); err != nil {
+			return nil
+		}
+	}
+	return nil
+}
+
+// place puts the child order at the current best price bounded by the limit
+func (e *twapExecution) place(ctx context.Context, slice int, amount decimal.Decimal) (twapChild, error) {
+	pollCtx, cancel := pollContext(ctx)
+	defer cancel()
+	tickers := make(chan wr.TickersResponse, 1)
+	go e.exchange.GetTickers(pollCtx, []string{e.plan.Pair}, tickers)
+	ticker := <-tickers
+	if ticker.Err != nil {
+		return twapChild{}, ticker.Err
+	}
+	child := twapChild{
+		Slice:  slice,
+		Rate:   e.plan.childRate(ticker.Tickers[e.plan.Pair], e.market.Precision),
+		Amount: amount,
+	}
+	// funds were checked for the whole parent order, market rules are checked without a request
+	if err := wr.ValidateOrder(e.exchange.Name, e.market, nil, e.plan.Side, child.Rate, child.Amount); err != nil {
+		return child, err
+	}
+	channel := make(chan wr.PlaceOrderResponse, 1)
+	go e.exchange.PlaceOrder(pollCtx, e.plan.Pair, e.plan.Side, child.Rate, child.Amount, channel)
+	rs := <-channel
+	if rs.Err != nil {
+		return child, rs.Err
+	}
+	child.OrderId = rs.Result.OrderId
+	child.Filled = child.Amount.Sub(rs.Result.Remains)
+	e.report.Children = append(e.report.Children, child)
+	fmt.Fprintf(os.Stderr, "%s slice %d/%d: %s %s %s at %s, order %s\n", time.Now().Format(time.Stamp),
+		slice+1, e.plan.Slices, strings.ToUpper(e.plan.Side), sprintDecimal(child.Amount), strings.ToUpper(e.plan.Pair),
+		sprintDecimal(child.Rate), child.OrderId)
+	return child, nil
+}
+
+// follow polls the child order until it's filled or the slice window ends, then cancels the rest.
+// Interrupted execution cancels the child order too.
+func (e *twapExecution) follow(ctx context.Context, child *twapChild, end time.Time) error {
+	defer func() {
+		e.report.Children[len(e.report.Children)-1] = *child
+		e.report.Filled = e.report.Filled.Add(child.Filled)
+	}()
+	for child.Filled.LessThan(child.Amount) {
+		next := time.Now().Add(e.pollInterval)
+		if next.After(end) {
+			next = end
+		}
+		interrupted := sleepUntil(ctx, next) != nil
+		if interrupted {
+			// ctx is done, the child order is cancelled anyway within calls of their own,
+			// wrappers bind HTTP requests to the context of the call
+			ctx = context.Background()
+		}
+		order, err := orderInfo(ctx, e.exchange, child.OrderId)
+		if err != nil {
+			return err
+		}
+		child.Filled = order.StartAmount.Sub(order.Amount)
+		if order.Status != wr.OrderActive {
+			if order.Status == wr.OrderFilled {
+				child.Filled = child.Amount
+			}
+			return nil
+		}
+		if interrupted || !time.Now().Before(end) {
+			return e.cancel(ctx, child)
+		}
+	}
+	return nil
+}
+
+// cancel cancels the unfilled child order and records its final fill
+func (e *twapExecution) cancel(ctx context.Context, child *twapChild) error {
+	_, cancelErr := submitCancel(ctx, e.exchange, child.OrderId)
+	order, err := orderInfo(ctx, e.exchange, child.OrderId)
+	if err != nil {
+		return err
+	}
+	child.Filled = order.StartAmount.Sub(order.Amount)
+	switch order.Status {
+	case wr.OrderFilled:
+		child.Filled = child.Amount
+	case wr.OrderActive:
+		if cancelErr == nil {
+			cancelErr = fmt.Errorf("order %s is still active", child.OrderId)
+		}
+		return cancelErr
+	}
+	fmt.Fprintf(os.Stderr, "%s slice %d/%d: order %s cancelled, filled %s of %s\n", time.Now().Format(time.Stamp),
+		child.Slice+1, e.plan.Slices, child.OrderId, sprintDecimal(child.Filled), sprintDecimal(child.Amount))
+	return nil
+}
+
+// summarize computes the average fill price and the slippage against the arrival price
+func (r *twapReport) summarize() {
+	if r.Filled.Sign() <= 0 {
+		return
+	}
+	value := decimal.Zero
+	for _, child := range r.Children {
+		value = value.Add(child.Rate.Mul(child.Filled))
+	}
+	r.AveragePrice = value.Div(r.Filled)
+	if r.ArrivalPrice.Sign() > 0 {
+		r.Slippage = percentOf(r.AveragePrice, r.ArrivalPrice)
+		if r.Side == wr.SideSell {
+			r.Slippage = r.Slippage.Neg()
+		}
+	}
+}
+
+// sleepUntil waits for the moment, the error is returned when ctx is done first
+func sleepUntil(ctx context.Context, moment time.Time) error {
+	select {
+	case <-time.After(time.Until(moment)):
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
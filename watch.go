@@ -0,0 +1,226 @@
+/*
+ * MIT License
+ *
+ * Copyright (c) 2018 Igor Konovalov
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+	. "github.com/logrusorgru/aurora"
+	"github.com/shopspring/decimal"
+	"golang.org/x/crypto/ssh/terminal"
+)
+
+// Terminal control sequences of the in place redrawing
+const (
+	escAltScreen  = "\x1b[?1049h"
+	escMainScreen = "\x1b[?1049l"
+	escHideCursor = "\x1b[?25l"
+	escShowCursor = "\x1b[?25h"
+	escHome       = "\x1b[H"
+	escClearLine  = "\x1b[K"
+	escClearDown  = "\x1b[J"
+)
+
+// watcher repeats the frame of a command. Table output of a terminal is redrawn in place on the
+// alternate screen with cells changed since the previous frame highlighted, other outputs get
+// frames one after another.
+type watcher struct {
+	interval time.Duration
+	inPlace  bool
+	// previous keeps plain lines of the last successful frame, lines keeps them highlighted
+	previous []string
+	lines    []string
+}
+
+// watchInterval raises the requested interval up to the minimal one allowed by rate limits
+func watchInterval(requested time.Duration, limits ...time.Duration) time.Duration {
+	if requested <= 0 {
+		return 0
+	}
+	rs := requested
+	for _, limit := range limits {
+		if limit > rs {
+			rs = limit
+		}
+	}
+	if rs != requested {
+		log.Printf("Watch interval %s is raised to %s by rate limits", requested, rs)
+	}
+	return rs
+}
+
+// watch runs the frame once when interval is zero, otherwise repeats it every interval until
+// ctx is cancelled. --timeout is applied to every repetition.
+func watch(ctx context.Context, interval time.Duration, frame func(ctx context.Context) error) {
+	if interval <= 0 {
+		if err := frame(ctx); err != nil {
+			fatal(err)
+		}
+		return
+	}
+	w := &watcher{
+		interval: interval,
+		inPlace:  *appOutput == outputTable && terminal.IsTerminal(int(os.Stdout.Fd())),
+	}
+	if w.inPlace {
+		fmt.Fprint(os.Stdout, escAltScreen+escHideCursor)
+		onRelease(func() {
+			fmt.Fprint(os.Stdout, escShowCursor+escMainScreen)
+		})
+	}
+	for {
+		w.poll(ctx, frame)
+		select {
+		case <-time.After(interval):
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// pollContext limits a single poll of the repeating command with --timeout
+func pollContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	if *appTimeout > 0 {
+		return context.WithTimeout(ctx, *appTimeout)
+	}
+	return context.WithCancel(ctx)
+}
+
+func (w *watcher) poll(ctx context.Context, frame func(ctx context.Context) error) {
+	pollCtx, cancel := pollContext(ctx)
+	defer cancel()
+
+	if !w.inPlace {
+		if err := frame(pollCtx); err != nil && ctx.Err() == nil {
+			fmt.Fprintln(os.Stderr, err)
+		}
+		return
+	}
+
+	// capture the frame to redraw the screen at once
+	var buffer bytes.Buffer
+	out := stdout
+	stdout = &buffer
+	err := frame(pollCtx)
+	stdout = out
+	if ctx.Err() != nil {
+		return
+	}
+
+	status := time.Now().Format("15:04:05")
+	if err != nil {
+		status = fmt.Sprintf("%s %s", status, Red(err.Error()))
+	} else {
+		lines := strings.Split(strings.TrimRight(buffer.String(), "\n"), "\n")
+		w.lines = w.highlight(lines)
+		w.previous = make([]string, len(lines))
+		for i, line := range lines {
+			w.previous[i] = ansiEscape.ReplaceAllString(line, "")
+		}
+	}
+	header := fmt.Sprintf("%s  %s", Bold(fmt.Sprintf("Every %s: gtr %s", w.interval, strings.Join(os.Args[1:], " "))), status)
+	w.draw(append([]string{header, ""}, w.lines...))
+}
+
+// draw writes lines over the previous screen, lines out of the terminal height are cut
+// so the screen never scrolls
+func (w *watcher) draw(lines []string) {
+	if _, height, err := terminal.GetSize(int(os.Stdout.Fd())); err == nil && len(lines) > height-1 && height > 1 {
+		lines = lines[:height-1]
+	}
+	var screen bytes.Buffer
+	screen.WriteString(escHome)
+	for _, line := range lines {
+		screen.WriteString(line + escClearLine + "\n")
+	}
+	screen.WriteString(escClearDown)
+	os.Stdout.Write(screen.Bytes())
+}
+
+// highlight marks lines which were not in the previous frame. Table rows are compared cell by
+// cell with the row at the same position, so moved rows (shifted trades) are not highlighted.
+func (w *watcher) highlight(lines []string) []string {
+	if w.previous == nil {
+		return lines
+	}
+	seen := make(map[string]bool, len(w.previous))
+	for _, line := range w.previous {
+		seen[line] = true
+	}
+	rs := make([]string, len(lines))
+	for i, line := range lines {
+		plain := ansiEscape.ReplaceAllString(line, "")
+		switch {
+		case seen[plain]:
+			rs[i] = line
+		case i < len(w.previous) && strings.Contains(plain, "|") && strings.Count(plain, "|") == strings.Count(w.previous[i], "|"):
+			rs[i] = highlightCells(line, plain, w.previous[i])
+		default:
+			rs[i] = Inverse(plain).String()
+		}
+	}
+	return rs
+}
+
+// highlightCells colors changed cells of the table row: green background when the number
+// grows, red when it falls, inverse for the other changes
+func highlightCells(line string, plain string, previous string) string {
+	cells := strings.Split(line, "|")
+	plainCells := strings.Split(plain, "|")
+	previousCells := strings.Split(previous, "|")
+	for i := range cells {
+		now, was := strings.TrimSpace(plainCells[i]), strings.TrimSpace(previousCells[i])
+		if now == was || now == "" {
+			continue
+		}
+		Colored := Inverse
+		nowValue, nowOk := leadingDecimal(now)
+		wasValue, wasOk := leadingDecimal(was)
+		if nowOk && wasOk {
+			if nowValue.GreaterThan(wasValue) {
+				Colored = BgGreen
+			} else if nowValue.LessThan(wasValue) {
+				Colored = BgRed
+			}
+		}
+		cells[i] = strings.Replace(plainCells[i], now, Colored(now).String(), 1)
+	}
+	return strings.Join(cells, "|")
+}
+
+// leadingDecimal parses the number the cell starts with: "0.01200000 +1.50%"
+func leadingDecimal(cell string) (decimal.Decimal, bool) {
+	fields := strings.Fields(cell)
+	if len(fields) == 0 {
+		return decimal.Zero, false
+	}
+	value, err := decimal.NewFromString(fields[0])
+	return value, err == nil
+}
@@ -25,15 +25,32 @@
 package wrappers
 
 import (
+	"context"
+	"fmt"
 	"github.com/toorop/go-bittrex"
 	"time"
 	"log"
 	"github.com/ikonovalov/go-cloudflare-scraper"
 	"net/http"
+	"strings"
+	"sync"
+	"github.com/shopspring/decimal"
 )
 
+const (
+	bittrexName       = "Bittrex"
+	bittrexTimeLayout = "2006-01-02T15:04:05"
+	// BittrexPollInterval keeps repeated polls within the Bittrex limit of one request per second
+	BittrexPollInterval = time.Second
+)
+
+// bittrexFee is the Bittrex taker fee in percents, it is the same for every market
+var bittrexFee = decimal.New(25, -2)
+
 type BittrexWrapper struct {
-	bittrex *bittrex.Bittrex
+	credential BittrexApiCredential
+	cloudflare *scraper.Transport
+	mu               sync.Mutex
 	availableMarkets map[string]bittrex.Market
 }
 
@@ -42,77 +59,388 @@ type BittrexApiCredential struct {
 	Secret string `json:"secret"`
 }
 
-func NewBittrex(credential BittrexApiCredential) *BittrexWrapper {
+// NewBittrex creates Bittrex client, markets are loaded within ctx.
+func NewBittrex(ctx context.Context, credential BittrexApiCredential) (*BittrexWrapper, error) {
 	cloudflare, err := scraper.NewTransport(http.DefaultTransport)
 	if err != nil {
-		fatal(err)
+		return nil, newProviderError(bittrexName, "NewTransport", err)
 	}
-	httpClient := &http.Client{Transport: cloudflare, Jar: cloudflare.Cookies, Timeout: time.Second * 10}
-	bittrexClient := bittrex.NewWithCustomHttpClient(credential.Key, credential.Secret, httpClient)
 
 	ba := BittrexWrapper{
-		bittrex: bittrexClient,
+		credential: credential,
+		cloudflare: cloudflare,
 		availableMarkets: make(map[string]bittrex.Market),
 	}
 
-	// upload markets
+	// upload markets, failed upload is repeated on the first markets lookup
+	if _, err := ba.markets(ctx); err != nil {
+		log.Printf("Bittrex.GetMarkets failed: %s", err)
+	}
+
+	return &ba, nil
+}
+
+// api returns the client library bound to the context of the call, every HTTP request of it is
+// cancelled with ctx. The cloudflare transport and its cookies are shared by all calls.
+func (bw *BittrexWrapper) api(ctx context.Context) *bittrex.Bittrex {
+	transport := &contextTransport{ctx: ctx, upstream: bw.cloudflare}
+	httpClient := &http.Client{Transport: transport, Jar: bw.cloudflare.Cookies, Timeout: time.Second * 10}
+	return bittrex.NewWithCustomHttpClient(bw.credential.Key, bw.credential.Secret, httpClient)
+}
+
+// markets returns available markets by Bittrex market name loading them once
+func (bw *BittrexWrapper) markets(ctx context.Context) (map[string]bittrex.Market, error) {
+	bw.mu.Lock()
+	defer bw.mu.Unlock()
+	if len(bw.availableMarkets) > 0 {
+		return bw.availableMarkets, nil
+	}
 	start := time.Now()
-	markets, err := bittrexClient.GetMarkets()
+	var markets []bittrex.Market
+	err := awaitCall(ctx, func() (err error) {
+		markets, err = bw.api(ctx).GetMarkets()
+		return
+	})
 	elapsed := time.Since(start)
 	log.Printf("Bittrex.GetMarkets took %s", elapsed)
+	if err != nil {
+		return nil, newProviderError(bittrexName, "GetMarkets", err)
+	}
 	for _, m := range markets {
-		ba.availableMarkets[m.MarketName] = m
+		bw.availableMarkets[m.MarketName] = m
 	}
+	return bw.availableMarkets, nil
+}
 
-	return &ba
+// market converts eth_btc pair into the listed BTC-ETH market name
+func (bw *BittrexWrapper) market(ctx context.Context, pair string) (string, error) {
+	markets, err := bw.markets(ctx)
+	if err != nil {
+		return "", err
+	}
+	name, err := bittrexSymbols.nativePair(pair)
+	if err != nil {
+		return "", newProviderError(bittrexName, "GetMarkets", err)
+	}
+	if _, ok := markets[name]; !ok {
+		return "", newProviderError(bittrexName, "GetMarkets", fmt.Errorf("market %s is not listed", pair))
+	}
+	return name, nil
 }
 
-func (bw *BittrexWrapper) GetBalances( ch chan<- Balance) {
+func (bw *BittrexWrapper) GetBalances(ctx context.Context, ch chan<- BalanceResponse) {
 	start := time.Now()
-	balances, err := bw.bittrex.GetBalances()
+	var balances []bittrex.Balance
+	err := awaitCall(ctx, func() (err error) {
+		balances, err = bw.api(ctx).GetBalances()
+		return
+	})
 	elapsed := time.Since(start)
 	log.Printf("Bittrex.GetBalances took %s", elapsed)
 	if err != nil {
-		fatal(err)
+		ch <- BalanceResponse{Err: newProviderError(bittrexName, "GetBalances", err)}
+		return
 	}
 	canonicalBalances := Balance{
-		Exchange:       Exchange{Name: "Bittrex", Link: "https://bittrex.com"},
-		Funds:          make(map[string]float64),
-		AvailableFunds: make(map[string]float64),
+		Exchange:       Exchange{Name: bittrexName, Link: "https://bittrex.com"},
+		Funds:          make(map[string]decimal.Decimal),
+		AvailableFunds: make(map[string]decimal.Decimal),
 	}
 	for _, bb := range balances {
-		balF64, _ := bb.Balance.Float64()
-		avaF64, _ := bb.Available.Float64()
-		canonicalBalances.Funds[bb.Currency] = balF64
-		canonicalBalances.AvailableFunds[bb.Currency] = avaF64
+		currency := bittrexSymbols.currency(bb.Currency)
+		canonicalBalances.Funds[currency] = canonicalBalances.Funds[currency].Add(bb.Balance)
+		canonicalBalances.AvailableFunds[currency] = canonicalBalances.AvailableFunds[currency].Add(bb.Available)
+	}
+	ch <- BalanceResponse{Balance: canonicalBalances}
+}
+
+func (bw *BittrexWrapper) Markets(ctx context.Context, ch chan<- MarketsResponse) {
+	markets, err := bw.markets(ctx)
+	if err != nil {
+		ch <- MarketsResponse{Err: err}
+		return
 	}
-	ch <- canonicalBalances
+	rs := make([]Market, 0, len(markets))
+	for name, m := range markets {
+		pair, err := bittrexSymbols.Canonical(name)
+		if err != nil {
+			continue
+		}
+		rs = append(rs, Market{
+			Pair:      pair,
+			Symbol:    name,
+			Hidden:    !m.IsActive,
+			Precision: 8,
+			MinAmount: m.MinTradeSize,
+			Fee:       bittrexFee,
+		})
+	}
+	ch <- MarketsResponse{Markets: rs}
 }
 
-func (bw *BittrexWrapper) GetTickers(paris []string, ch chan <- map[string]Ticker) {
-	marketSummaries, err := bw.bittrex.GetMarketSummaries()
+// GetTickers returns tickers of the pairs, all markets when pairs are empty
+func (bw *BittrexWrapper) GetTickers(ctx context.Context, pairs []string, ch chan <- TickersResponse) {
+	var marketSummaries []bittrex.MarketSummary
+	err := awaitCall(ctx, func() (err error) {
+		marketSummaries, err = bw.api(ctx).GetMarketSummaries()
+		return
+	})
 	if err != nil {
-		fatal(err)
+		ch <- TickersResponse{Err: newProviderError(bittrexName, "GetMarketSummaries", err)}
+		return
+	}
+	wanted := make(map[string]bool, len(pairs))
+	for _, pair := range pairs {
+		p, err := ParsePair(pair)
+		if err != nil {
+			ch <- TickersResponse{Err: newProviderError(bittrexName, "GetMarketSummaries", err)}
+			return
+		}
+		wanted[p.String()] = true
 	}
 	rs := make(map[string]Ticker)
 	for _, m := range marketSummaries {
-		hi, _ := m.High.Float64()
-		lo, _ := m.Low.Float64()
-		la, _ := m.Last.Float64()
-		as, _ := m.Ask.Float64()
-		bi, _ := m.Bid.Float64()
-		vo, _ := m.Volume.Float64()
-		rs[m.MarketName] = Ticker{
-			High: hi,
-			Low:  lo,
-			Last: la,
-			Sell: as,
-			Buy: bi,
-			Vol: vo,
+		pair := bittrexSymbols.canonicalPair(m.MarketName)
+		if len(wanted) > 0 && !wanted[pair] {
+			continue
+		}
+		updated, _ := time.Parse(bittrexTimeLayout, m.TimeStamp)
+		rs[pair] = Ticker{
+			High:    m.High,
+			Low:     m.Low,
+			PrevDay: m.PrevDay,
+			Last:    m.Last,
+			Sell:    m.Ask,
+			Buy:     m.Bid,
+			Vol:     m.Volume,
+			VolCur:  m.BaseVolume,
+			Updated: updated.Unix(),
+		}
+	}
+	for pair := range wanted {
+		if _, ok := rs[pair]; !ok {
+			ch <- TickersResponse{Err: newProviderError(bittrexName, "GetMarketSummaries", fmt.Errorf("market %s is not listed", pair))}
+			return
+		}
+	}
+	ch <- TickersResponse{Tickers: rs}
+}
+
+func (bw *BittrexWrapper) OrderBook(ctx context.Context, pair string, limit int, ch chan<- OrderBookResponse) {
+	market, err := bw.market(ctx, pair)
+	if err != nil {
+		ch <- OrderBookResponse{Err: err}
+		return
+	}
+	var book bittrex.OrderBook
+	err = awaitCall(ctx, func() (err error) {
+		book, err = bw.api(ctx).GetOrderBook(market, "both")
+		return
+	})
+	if err != nil {
+		ch <- OrderBookResponse{Err: newProviderError(bittrexName, "GetOrderBook", err)}
+		return
+	}
+	levels := func(orders []bittrex.Orderb) []OrderBookLevel {
+		if limit > 0 && len(orders) > limit {
+			orders = orders[:limit]
+		}
+		rs := make([]OrderBookLevel, 0, len(orders))
+		for _, o := range orders {
+			rs = append(rs, OrderBookLevel{Price: o.Rate, Quantity: o.Quantity})
 		}
+		return rs
 	}
+	ch <- OrderBookResponse{OrderBook: OrderBook{Pair: pair, Asks: levels(book.Sell), Bids: levels(book.Buy)}}
+}
+
+func (bw *BittrexWrapper) Trades(ctx context.Context, pair string, limit int, ch chan<- TradesResponse) {
+	market, err := bw.market(ctx, pair)
+	if err != nil {
+		ch <- TradesResponse{Err: err}
+		return
+	}
+	var trades []bittrex.Trade
+	err = awaitCall(ctx, func() (err error) {
+		trades, err = bw.api(ctx).GetMarketHistory(market)
+		return
+	})
+	if err != nil {
+		ch <- TradesResponse{Err: newProviderError(bittrexName, "GetMarketHistory", err)}
+		return
+	}
+	if limit > 0 && len(trades) > limit {
+		trades = trades[:limit]
+	}
+	rs := make([]Trade, 0, len(trades))
+	for _, t := range trades {
+		rs = append(rs, Trade{
+			Id:        fmt.Sprint(t.OrderUuid),
+			Pair:      pair,
+			Side:      bittrexSide(t.OrderType),
+			Price:     t.Price,
+			Amount:    t.Quantity,
+			Timestamp: time.Time(t.Timestamp).Unix(),
+		})
+	}
+	ch <- TradesResponse{Trades: rs}
 }
 
 func (bw *BittrexWrapper) Release()  {
 	// nothing to do now
 }
+
+func bittrexSide(orderType string) string {
+	if strings.Contains(orderType, "BUY") {
+		return SideBuy
+	}
+	return SideSell
+}
+
+func (bw *BittrexWrapper) PlaceOrder(ctx context.Context, pair string, side string, rate decimal.Decimal, amount decimal.Decimal, ch chan<- PlaceOrderResponse) {
+	market, err := bittrexSymbols.nativePair(pair)
+	if err != nil {
+		ch <- PlaceOrderResponse{Err: newProviderError(bittrexName, "PlaceOrder", err)}
+		return
+	}
+	var uuid string
+	start := time.Now()
+	err = awaitCall(ctx, func() (err error) {
+		if side == SideBuy {
+			uuid, err = bw.api(ctx).BuyLimit(market, amount, rate)
+		} else {
+			uuid, err = bw.api(ctx).SellLimit(market, amount, rate)
+		}
+		return
+	})
+	elapsed := time.Since(start)
+	log.Printf("Bittrex.PlaceOrder(%s) took %s", side, elapsed)
+	if err != nil && ctx.Err() != nil {
+		// the cancelled request may have reached Bittrex
+		err = ErrOrderOutcomeUnknown
+	}
+	if err != nil {
+		ch <- PlaceOrderResponse{Err: newProviderError(bittrexName, "PlaceOrder", err)}
+		return
+	}
+	ch <- PlaceOrderResponse{Result: OrderResult{OrderId: uuid, Remains: amount}}
+}
+
+func (bw *BittrexWrapper) CancelOrder(ctx context.Context, orderId string, ch chan<- CancelOrderResponse) {
+	err := awaitCall(ctx, func() error {
+		return bw.api(ctx).CancelOrder(orderId)
+	})
+	if err != nil {
+		ch <- CancelOrderResponse{Err: newProviderError(bittrexName, "CancelOrder", err)}
+		return
+	}
+	ch <- CancelOrderResponse{Result: CancelResult{OrderId: orderId}}
+}
+
+func (bw *BittrexWrapper) OpenOrders(ctx context.Context, pair string, ch chan<- OrdersResponse) {
+	market, err := bittrexSymbols.nativePair(pair)
+	if err != nil {
+		ch <- OrdersResponse{Err: newProviderError(bittrexName, "GetOpenOrders", err)}
+		return
+	}
+	if market == "" {
+		market = "all"
+	}
+	var orders []bittrex.Order
+	err = awaitCall(ctx, func() (err error) {
+		orders, err = bw.api(ctx).GetOpenOrders(market)
+		return
+	})
+	if err != nil {
+		ch <- OrdersResponse{Err: newProviderError(bittrexName, "GetOpenOrders", err)}
+		return
+	}
+	rs := make([]Order, 0, len(orders))
+	for _, o := range orders {
+		rs = append(rs, Order{
+			Id:          o.OrderUuid,
+			Pair:        bittrexSymbols.canonicalPair(o.Exchange),
+			Side:        bittrexSide(o.OrderType),
+			Rate:        o.Limit,
+			StartAmount: o.Quantity,
+			Amount:      o.QuantityRemaining,
+			Created:     time.Time(o.TimeStamp).Unix(),
+			Status:      OrderActive,
+		})
+	}
+	ch <- OrdersResponse{Orders: rs}
+}
+
+func (bw *BittrexWrapper) OrderInfo(ctx context.Context, orderId string, ch chan<- OrderInfoResponse) {
+	var o bittrex.Order2
+	err := awaitCall(ctx, func() (err error) {
+		o, err = bw.api(ctx).GetOrder(orderId)
+		return
+	})
+	if err != nil {
+		ch <- OrderInfoResponse{Err: newProviderError(bittrexName, "GetOrder", err)}
+		return
+	}
+	created, _ := time.Parse(bittrexTimeLayout, o.Opened)
+
+	var status OrderStatus
+	switch {
+	case o.IsOpen:
+		status = OrderActive
+	case o.QuantityRemaining.IsZero():
+		status = OrderFilled
+	case o.QuantityRemaining.LessThan(o.Quantity):
+		status = OrderPartiallyCancelled
+	default:
+		status = OrderCancelled
+	}
+
+	ch <- OrderInfoResponse{Order: Order{
+		Id:          o.OrderUuid,
+		Pair:        bittrexSymbols.canonicalPair(o.Exchange),
+		Side:        bittrexSide(o.Type),
+		Rate:        o.Limit,
+		StartAmount: o.Quantity,
+		Amount:      o.QuantityRemaining,
+		Created:     created.Unix(),
+		Status:      status,
+	}}
+}
+
+func (bw *BittrexWrapper) TradeHistory(ctx context.Context, pair string, ch chan<- TradeHistoryResponse) {
+	market, err := bittrexSymbols.nativePair(pair)
+	if err != nil {
+		ch <- TradeHistoryResponse{Err: newProviderError(bittrexName, "GetOrderHistory", err)}
+		return
+	}
+	if market == "" {
+		market = "all"
+	}
+	var orders []bittrex.Order
+	err = awaitCall(ctx, func() (err error) {
+		orders, err = bw.api(ctx).GetOrderHistory(market)
+		return
+	})
+	if err != nil {
+		ch <- TradeHistoryResponse{Err: newProviderError(bittrexName, "GetOrderHistory", err)}
+		return
+	}
+	rs := make([]Fill, 0, len(orders))
+	for _, o := range orders {
+		// orders cancelled before any execution are in the history too
+		if o.Quantity.Sub(o.QuantityRemaining).Sign() <= 0 {
+			continue
+		}
+		rs = append(rs, Fill{
+			Id:        o.OrderUuid,
+			OrderId:   o.OrderUuid,
+			Pair:      bittrexSymbols.canonicalPair(o.Exchange),
+			Side:      bittrexSide(o.OrderType),
+			Rate:      o.PricePerUnit,
+			Amount:    o.Quantity.Sub(o.QuantityRemaining),
+			Fee:       o.Commission,
+			Timestamp: time.Time(o.TimeStamp).Unix(),
+		})
+	}
+	ch <- TradeHistoryResponse{Fills: rs}
+}
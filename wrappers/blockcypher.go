@@ -25,51 +25,144 @@
 package wrappers
 
 import (
+	"context"
+	"fmt"
 	"github.com/blockcypher/gobcy"
+	"github.com/shopspring/decimal"
+	"sort"
+	"strings"
 	"time"
-	"math"
 )
 
-var(
-	BlockCypher = Exchange{Name: "LiteCoin", Link: "blockcypher.com", Cold: true}
-	litecoinDecimalPoint = math.Pow(10.0, 8.0)
+const (
+	blockCypherName = "BlockCypher"
+	// BlockCypherPollInterval is the minimal interval of repeated polls of a single address,
+	// BlockCypher limits the public API to 200 requests per hour
+	BlockCypherPollInterval = 18 * time.Second
 )
 
 type (
 	BlockCypherCredential struct {
+		// Addresses lists watched addresses by lowercase coin symbol: btc, ltc, doge, dash
+		Addresses map[string][]string `json:"addresses,omitempty"`
+		// LTC is the LiteCoin addresses list of credentials version 1
 		LTC []string `json:"ltc,omitempty"`
+		// Labels are user-assigned address names by address
+		Labels map[string]string `json:"labels,omitempty"`
+	}
+
+	// blockCypherCoin describes a blockchain served by BlockCypher
+	blockCypherCoin struct {
+		Symbol string
+		Name   string
+		// DecimalPoint is the exponent of the smallest coin unit (satoshi, litoshi...)
+		DecimalPoint int32
+	}
+
+	BlochCypherBalances struct {
+		Coin      string
+		Addresses []gobcy.Addr
+	}
+
+	BlockCypherBalancesResponse struct {
+		Balances BlochCypherBalances
+		Err      error
 	}
-	BlochCypherBalances []gobcy.Addr
 )
 
+var blockCypherCoins = map[string]blockCypherCoin{
+	"btc":  {Symbol: "BTC", Name: "Bitcoin", DecimalPoint: 8},
+	"ltc":  {Symbol: "LTC", Name: "LiteCoin", DecimalPoint: 8},
+	"doge": {Symbol: "DOGE", Name: "Dogecoin", DecimalPoint: 8},
+	"dash": {Symbol: "DASH", Name: "Dash", DecimalPoint: 8},
+}
+
+// BlockCypherCoins returns sorted symbols of supported coins
+func BlockCypherCoins() []string {
+	rs := make([]string, 0, len(blockCypherCoins))
+	for coin := range blockCypherCoins {
+		rs = append(rs, coin)
+	}
+	sort.Strings(rs)
+	return rs
+}
+
+// IsBlockCypherCoin reports whether coin balances can be fetched from BlockCypher
+func IsBlockCypherCoin(coin string) bool {
+	_, ok := blockCypherCoins[strings.ToLower(coin)]
+	return ok
+}
+
+// BlockCypherExchange is the cold wallet pseudo exchange of the coin
+func BlockCypherExchange(coin string) Exchange {
+	name := strings.ToUpper(coin)
+	if c, ok := blockCypherCoins[strings.ToLower(coin)]; ok {
+		name = c.Name
+	}
+	return Exchange{Name: name, Link: "blockcypher.com", Cold: true}
+}
+
 func (bcb BlochCypherBalances) SummaryBalance() (Balance) {
-	totalBalance := 0.0
-	for _, addr := range bcb {
-		totalBalance += float64(addr.FinalBalance)
+	coin := blockCypherCoins[bcb.Coin]
+	totalBalance := decimal.Zero
+	for _, addr := range bcb.Addresses {
+		totalBalance = totalBalance.Add(decimal.New(int64(addr.FinalBalance), -coin.DecimalPoint))
 	}
 
-	funds := map[string]float64{ "LTC": totalBalance / litecoinDecimalPoint}
+	funds := map[string]decimal.Decimal{ coin.Symbol: totalBalance}
 
 	return Balance{
-		Exchange:       BlockCypher,
+		Exchange:       BlockCypherExchange(bcb.Coin),
 		Funds: funds,
 		AvailableFunds: funds,
 	}
 }
 
-func GetLiteCoinBalances(accounts []string, ch chan <- BlochCypherBalances)  {
-	btc := gobcy.API{ Coin:"ltc", Chain: "main"}
+// AddressBalances returns a balance per address labeled from labels
+func (bcb BlochCypherBalances) AddressBalances(labels map[string]string) []Balance {
+	coin := blockCypherCoins[bcb.Coin]
+	rs := make([]Balance, 0, len(bcb.Addresses))
+	for _, addr := range bcb.Addresses {
+		funds := map[string]decimal.Decimal{coin.Symbol: decimal.New(int64(addr.FinalBalance), -coin.DecimalPoint)}
+		rs = append(rs, Balance{
+			Exchange:       BlockCypherExchange(bcb.Coin),
+			Funds:          funds,
+			AvailableFunds: funds,
+			Address:        addr.Address,
+			Label:          labels[addr.Address],
+		})
+	}
+	return rs
+}
+
+func GetBlockCypherBalances(ctx context.Context, coin string, accounts []string, ch chan <- BlockCypherBalancesResponse)  {
+	coin = strings.ToLower(coin)
+	if !IsBlockCypherCoin(coin) {
+		ch <- BlockCypherBalancesResponse{Err: newProviderError(blockCypherName, "GetAddrBal", fmt.Errorf("unsupported coin %s", coin))}
+		return
+	}
+	api := gobcy.API{ Coin: coin, Chain: "main"}
 	accLen := len(accounts)
 	rs := make([]gobcy.Addr, 0, accLen)
 	for _, acc := range accounts {
-		addr, err := btc.GetAddrBal(acc, nil)
+		var addr gobcy.Addr
+		err := awaitCall(ctx, func() (err error) {
+			addr, err = api.GetAddrBal(acc, nil)
+			return
+		})
 		if err != nil {
-			fatal(err)
+			ch <- BlockCypherBalancesResponse{Err: newProviderError(blockCypherName, "GetAddrBal("+coin+")", err)}
+			return
 		}
 		rs = append(rs, addr)
 		if accLen > 1 {
-			time.Sleep(time.Millisecond * 200)
+			select {
+			case <-time.After(time.Millisecond * 200):
+			case <-ctx.Done():
+				ch <- BlockCypherBalancesResponse{Err: newProviderError(blockCypherName, "GetAddrBal("+coin+")", ctx.Err())}
+				return
+			}
 		}
 	}
-	ch <- rs
+	ch <- BlockCypherBalancesResponse{Balances: BlochCypherBalances{Coin: coin, Addresses: rs}}
 }
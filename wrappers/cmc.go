@@ -25,19 +25,49 @@
 package wrappers
 
 import (
+	"context"
 	coinApi "github.com/miguelmota/go-coinmarketcap"
 	"time"
 	"log"
+	"github.com/shopspring/decimal"
 )
 
+// CoinMarketCapPollInterval is the minimal interval of repeated polls, CoinMarketCap updates prices
+// every 5 minutes and limits the public API to 30 requests per minute
+const CoinMarketCapPollInterval = time.Minute
+
+// CoinMarketCapHistoryInterval spaces price history requests within the public API limit
+const CoinMarketCapHistoryInterval = 2 * time.Second
+
 type CoinMarketCap struct {
 }
 
-func (mc *CoinMarketCap) GetMarketData(ch chan<- map[string]coinApi.Coin) {
+type MarketDataResponse struct {
+	Coins map[string]coinApi.Coin
+	Err   error
+}
+
+// PricePoint is the USD price of a coin at the unix time
+type PricePoint struct {
+	Timestamp int64
+	Usd       decimal.Decimal
+}
+
+type UsdHistoryResponse struct {
+	Prices []PricePoint
+	Err    error
+}
+
+func (mc *CoinMarketCap) GetMarketData(ctx context.Context, ch chan<- MarketDataResponse) {
 	start := time.Now()
-	top, err := coinApi.GetAllCoinData(1000)
+	var top map[string]coinApi.Coin
+	err := awaitCall(ctx, func() (err error) {
+		top, err = coinApi.GetAllCoinData(1000)
+		return
+	})
 	if err != nil {
-		fatal(err)
+		ch <- MarketDataResponse{Err: newProviderError("CoinMarketCap", "GetAllCoinData", err)}
+		return
 	}
 	elapsed := time.Since(start)
 	log.Printf("CMC.GetMarketData (TOP100) took %s", elapsed)
@@ -46,5 +76,28 @@ func (mc *CoinMarketCap) GetMarketData(ch chan<- map[string]coinApi.Coin) {
 	for _, coin := range top {
 		rs[coin.Symbol] = coin
 	}
-	ch <- rs
+	ch <- MarketDataResponse{Coins: rs}
+}
+
+// GetUsdHistory fetches USD prices of the coin between the unix times, coin is the CoinMarketCap id:
+// bitcoin, ethereum. A day range is returned with 5 minutes resolution.
+func (mc *CoinMarketCap) GetUsdHistory(ctx context.Context, coin string, from int64, to int64, ch chan<- UsdHistoryResponse) {
+	var graph coinApi.CoinGraph
+	err := awaitCall(ctx, func() (err error) {
+		graph, err = coinApi.GetCoinGraphData(coin, from, to)
+		return
+	})
+	if err != nil {
+		ch <- UsdHistoryResponse{Err: newProviderError("CoinMarketCap", "GetCoinGraphData", err)}
+		return
+	}
+	rs := make([]PricePoint, 0, len(graph.PriceUsd))
+	for _, point := range graph.PriceUsd {
+		if len(point) < 2 {
+			continue
+		}
+		// graph points are [unix milliseconds, price]
+		rs = append(rs, PricePoint{Timestamp: int64(point[0]) / 1000, Usd: decimal.NewFromFloat(point[1])})
+	}
+	ch <- UsdHistoryResponse{Prices: rs}
 }
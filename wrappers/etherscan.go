@@ -25,16 +25,28 @@
 package wrappers
 
 import (
+	"context"
 	"net/http"
+	"net/url"
 	"time"
 	"strings"
 	"fmt"
 	"io/ioutil"
 	"encoding/json"
+	"errors"
 	"github.com/shopspring/decimal"
 	"log"
 )
 
+const (
+	etherScanName = "EtherScan"
+	etherScanApi  = "https://api.etherscan.io/api"
+	// weiDecimalPoint is the exponent of wei, the smallest ETH unit
+	weiDecimalPoint = 18
+	// etherScanThrottle keeps requests under the free plan limit of 5 calls per second
+	etherScanThrottle = time.Millisecond * 200
+)
+
 var (
 	EtherScan = Exchange{Name: "Ethereum", Link: "etherscan.io", Cold: true}
 	client    = http.Client{Timeout: time.Second * 10}
@@ -42,46 +54,75 @@ var (
 
 type (
 	EtherScanCredential struct {
-		Accounts []string `json:"accounts"`
+		ApiKey   string          `json:"apikey,omitempty"`
+		Accounts []string        `json:"accounts"`
+		Tokens   []EthereumToken `json:"tokens,omitempty"`
+		// Labels are user-assigned account names by lowercase account
+		Labels map[string]string `json:"labels,omitempty"`
+	}
+
+	// EthereumToken is an ERC-20 contract watched on every account
+	EthereumToken struct {
+		Contract string `json:"contract"`
+		Symbol   string `json:"symbol"`
+		Decimals int32  `json:"decimals"`
 	}
 
-	EtherScanAccountBalancesResponse struct {
-		Status  string            `json:"status"`
-		Message string            `json:"message"`
-		Result  []EthereumBalance `json:"result"`
+	etherScanResponse struct {
+		Status  string          `json:"status"`
+		Message string          `json:"message"`
+		Result  json.RawMessage `json:"result"`
 	}
 
 	EthereumBalance struct {
 		Account string          `json:"account"`
 		Balance decimal.Decimal `json:"balance"`
+		// Tokens holds ERC-20 balances by symbol already scaled by the token decimals
+		Tokens map[string]decimal.Decimal `json:"-"`
 	}
 
 	EthereumBalances []EthereumBalance
+
+	EthereumBalancesResponse struct {
+		Balances EthereumBalances
+		Err      error
+	}
 )
 
 func (e *EthereumBalance) ToBalance() Balance {
-	balanceF64wei, exec := e.Balance.Float64()
-	if !exec {
-		fatal("Decimal balance overflow")
+	funds := map[string]decimal.Decimal{"ETH": e.Balance.Shift(-weiDecimalPoint)}
+	for symbol, amount := range e.Tokens {
+		funds[symbol] = funds[symbol].Add(amount)
 	}
-	funds := map[string]float64{"ETH": balanceF64wei / 1000000000000000000.0}
 	return Balance{
 		Exchange:       EtherScan,
 		Funds:          funds,
 		AvailableFunds: funds,
+		Address:        e.Account,
+	}
+}
+
+// AddressBalances returns a balance per account labeled from labels
+func (e EthereumBalances) AddressBalances(labels map[string]string) []Balance {
+	rs := make([]Balance, 0, len(e))
+	for i := range e {
+		balance := e[i].ToBalance()
+		balance.Label = labels[strings.ToLower(e[i].Account)]
+		rs = append(rs, balance)
 	}
+	return rs
 }
 
 func (e EthereumBalances) SummaryBalance() Balance {
-	totalBalance := 0.0
+	totalBalance := decimal.Zero
+	funds := make(map[string]decimal.Decimal)
 	for _, b := range e {
-		balanceF64, exec := b.Balance.Float64()
-		if !exec {
-			fatal("Decimal overflow for ", b.Account)
+		totalBalance = totalBalance.Add(b.Balance)
+		for symbol, amount := range b.Tokens {
+			funds[symbol] = funds[symbol].Add(amount)
 		}
-		totalBalance += balanceF64 / 1000000000000000000.0
 	}
-	funds := map[string]float64{"ETH": totalBalance}
+	funds["ETH"] = funds["ETH"].Add(totalBalance.Shift(-weiDecimalPoint))
 
 	return Balance{
 		Exchange:       EtherScan,
@@ -90,27 +131,92 @@ func (e EthereumBalances) SummaryBalance() Balance {
 	}
 }
 
-func GetEthereumBalances(addresses []string, ch chan<- EthereumBalances) {
-	addressesLine := strings.Join(addresses, ",")
-	queryString := fmt.Sprintf(
-		"https://api.etherscan.io/api?module=%s&action=%s&address=%s&tag=latest",
-		"account",
-		"balancemulti",
-		addressesLine,
-	)
+// etherScanCall performs the EtherScan API call and decodes the result field of a successful response into rs
+func etherScanCall(ctx context.Context, op string, apiKey string, params url.Values, rs interface{}) error {
+	if apiKey != "" {
+		params.Set("apikey", apiKey)
+	}
+	request, err := http.NewRequest(http.MethodGet, etherScanApi+"?"+params.Encode(), nil)
+	if err != nil {
+		return newProviderError(etherScanName, op, err)
+	}
 	start := time.Now()
-	resp, err := client.Get(queryString)
+	resp, err := client.Do(request.WithContext(ctx))
 	elapsed := time.Since(start)
-	log.Printf("EtherScan.Account.BalanceMulti took %s", elapsed)
+	log.Printf("EtherScan.Account.%s took %s", op, elapsed)
 	if err != nil {
-		fatal(err)
+		return newProviderError(etherScanName, op, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return newProviderError(etherScanName, op, fmt.Errorf("unexpected status %s", resp.Status))
 	}
-	responseBytes, _ := ioutil.ReadAll(resp.Body)
-	var responseStructure EtherScanAccountBalancesResponse
-	err = json.Unmarshal(responseBytes, &responseStructure)
+	responseBytes, err := ioutil.ReadAll(resp.Body)
 	if err != nil {
-		fatal(err)
+		return newProviderError(etherScanName, op, err)
 	}
-	defer resp.Body.Close()
-	ch <- responseStructure.Result
+	var responseStructure etherScanResponse
+	if err = json.Unmarshal(responseBytes, &responseStructure); err != nil {
+		return newProviderError(etherScanName, op, err)
+	}
+	if responseStructure.Status != "1" {
+		message := responseStructure.Message
+		var details string
+		if json.Unmarshal(responseStructure.Result, &details) == nil && details != "" {
+			message += ": " + details
+		}
+		return newProviderError(etherScanName, op, errors.New(message))
+	}
+	if err = json.Unmarshal(responseStructure.Result, rs); err != nil {
+		return newProviderError(etherScanName, op, err)
+	}
+	return nil
+}
+
+// GetEthereumBalances fetches ETH balances of all credential accounts with a single balancemulti call
+// and then every configured ERC-20 token balance of each account.
+func GetEthereumBalances(ctx context.Context, credential EtherScanCredential, ch chan<- EthereumBalancesResponse) {
+	if len(credential.Accounts) == 0 {
+		ch <- EthereumBalancesResponse{Balances: EthereumBalances{}}
+		return
+	}
+	var balances EthereumBalances
+	err := etherScanCall(ctx, "BalanceMulti", credential.ApiKey, url.Values{
+		"module":  {"account"},
+		"action":  {"balancemulti"},
+		"address": {strings.Join(credential.Accounts, ",")},
+		"tag":     {"latest"},
+	}, &balances)
+	if err != nil {
+		ch <- EthereumBalancesResponse{Err: err}
+		return
+	}
+	for i := range balances {
+		if len(credential.Tokens) > 0 {
+			balances[i].Tokens = make(map[string]decimal.Decimal, len(credential.Tokens))
+		}
+		for _, token := range credential.Tokens {
+			select {
+			case <-time.After(etherScanThrottle):
+			case <-ctx.Done():
+				ch <- EthereumBalancesResponse{Err: newProviderError(etherScanName, "TokenBalance", ctx.Err())}
+				return
+			}
+			var raw decimal.Decimal
+			err := etherScanCall(ctx, "TokenBalance", credential.ApiKey, url.Values{
+				"module":          {"account"},
+				"action":          {"tokenbalance"},
+				"contractaddress": {token.Contract},
+				"address":         {balances[i].Account},
+				"tag":             {"latest"},
+			}, &raw)
+			if err != nil {
+				ch <- EthereumBalancesResponse{Err: err}
+				return
+			}
+			symbol := strings.ToUpper(token.Symbol)
+			balances[i].Tokens[symbol] = balances[i].Tokens[symbol].Add(raw.Shift(-token.Decimals))
+		}
+	}
+	ch <- EthereumBalancesResponse{Balances: balances}
 }
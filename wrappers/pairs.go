@@ -0,0 +1,171 @@
+/*
+ * MIT License
+ *
+ * Copyright (c) 2018 Igor Konovalov
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+package wrappers
+
+import (
+	"fmt"
+	"github.com/shopspring/decimal"
+	"regexp"
+	"strings"
+)
+
+// Pair is a canonical currency pair. Base and Quote are upper case canonical symbols,
+// the textual form is the lowercase base_quote: eth_btc, bch_usd.
+type Pair struct {
+	Base  string
+	Quote string
+}
+
+// SymbolConverter converts canonical pairs into the exchange native market symbols and back
+type SymbolConverter interface {
+	Native(pair Pair) string
+	Canonical(native string) (Pair, error)
+}
+
+// symbolTable is SymbolConverter of an exchange. Aliases map canonical currency symbols to
+// the exchange ones, e.g. Bitcoin Cash is BCH on CoinMarketCap and BCC on Bittrex.
+type symbolTable struct {
+	exchange string
+	aliases  map[string]string
+	reverse  map[string]string
+	format   func(base, quote string) string
+	split    func(native string) (base, quote string, ok bool)
+}
+
+var (
+	pairPattern = regexp.MustCompile("^[a-z0-9]+_[a-z0-9]+$")
+
+	// canonicalAliases are symbols accepted on input and replaced with the canonical ones
+	canonicalAliases = map[string]string{"BCC": "BCH", "XBT": "BTC"}
+
+	yobitSymbols = newSymbolTable(yobitName, map[string]string{"BCH": "BCC"},
+		func(base, quote string) string { return strings.ToLower(base + "_" + quote) },
+		func(native string) (string, string, bool) {
+			currencies := strings.Split(native, "_")
+			return currencies[0], currencies[len(currencies)-1], len(currencies) == 2
+		},
+	)
+
+	bittrexSymbols = newSymbolTable(bittrexName, map[string]string{"BCH": "BCC"},
+		func(base, quote string) string { return quote + "-" + base },
+		func(native string) (string, string, bool) {
+			currencies := strings.Split(native, "-")
+			return currencies[len(currencies)-1], currencies[0], len(currencies) == 2
+		},
+	)
+)
+
+// ParsePair reads the canonical eth_btc pair syntax, case insensitive
+func ParsePair(s string) (Pair, error) {
+	pair := strings.ToLower(strings.TrimSpace(s))
+	if !pairPattern.MatchString(pair) {
+		return Pair{}, fmt.Errorf("'%s' is not a pair, use base_quote: eth_btc, doge_usd", s)
+	}
+	currencies := strings.Split(pair, "_")
+	return NewPair(currencies[0], currencies[1]), nil
+}
+
+// NewPair creates canonical pair replacing known symbol aliases
+func NewPair(base string, quote string) Pair {
+	return Pair{Base: canonicalSymbol(base), Quote: canonicalSymbol(quote)}
+}
+
+func canonicalSymbol(symbol string) string {
+	symbol = strings.ToUpper(symbol)
+	if canonical, ok := canonicalAliases[symbol]; ok {
+		return canonical
+	}
+	return symbol
+}
+
+func (p Pair) String() string {
+	return strings.ToLower(p.Base + "_" + p.Quote)
+}
+
+func newSymbolTable(exchange string, aliases map[string]string, format func(base, quote string) string, split func(native string) (string, string, bool)) symbolTable {
+	reverse := make(map[string]string, len(aliases))
+	for canonical, native := range aliases {
+		reverse[native] = canonical
+	}
+	return symbolTable{exchange: exchange, aliases: aliases, reverse: reverse, format: format, split: split}
+}
+
+func (t symbolTable) Native(pair Pair) string {
+	currency := func(symbol string) string {
+		if native, ok := t.aliases[symbol]; ok {
+			return native
+		}
+		return symbol
+	}
+	return t.format(currency(pair.Base), currency(pair.Quote))
+}
+
+func (t symbolTable) Canonical(native string) (Pair, error) {
+	base, quote, ok := t.split(strings.ToUpper(native))
+	if !ok {
+		return Pair{}, fmt.Errorf("%s market %s is not a pair", t.exchange, native)
+	}
+	return Pair{Base: t.currency(base), Quote: t.currency(quote)}, nil
+}
+
+// currency converts the exchange currency symbol into the canonical upper case one
+func (t symbolTable) currency(native string) string {
+	native = strings.ToUpper(native)
+	if canonical, ok := t.reverse[native]; ok {
+		return canonical
+	}
+	return canonicalSymbol(native)
+}
+
+// funds re-keys exchange balances by canonical currency symbols
+func (t symbolTable) funds(funds map[string]decimal.Decimal) map[string]decimal.Decimal {
+	rs := make(map[string]decimal.Decimal, len(funds))
+	for symbol, amount := range funds {
+		currency := t.currency(symbol)
+		rs[currency] = rs[currency].Add(amount)
+	}
+	return rs
+}
+
+// nativePair converts the canonical pair text, empty pair stays empty meaning all markets
+func (t symbolTable) nativePair(pair string) (string, error) {
+	if pair == "" {
+		return "", nil
+	}
+	p, err := ParsePair(pair)
+	if err != nil {
+		return "", err
+	}
+	return t.Native(p), nil
+}
+
+// canonicalPair converts the native market into the canonical pair text keeping unknown formats as is
+func (t symbolTable) canonicalPair(native string) string {
+	p, err := t.Canonical(native)
+	if err != nil {
+		return strings.ToLower(native)
+	}
+	return p.String()
+}
@@ -25,21 +25,47 @@
 package wrappers
 
 import (
+	"context"
+	"errors"
 	"fmt"
-	"os"
+	"github.com/shopspring/decimal"
+	"net/http"
+	"time"
 )
 
 type (
 	CryptCurrencyExchange interface {
-		GetTickers([]string, chan<- map[string]Ticker)
-		GetBalances(ch chan<- Balance)
+		Markets(ctx context.Context, ch chan<- MarketsResponse)
+		GetTickers(ctx context.Context, pairs []string, ch chan<- TickersResponse)
+		OrderBook(ctx context.Context, pair string, limit int, ch chan<- OrderBookResponse)
+		Trades(ctx context.Context, pair string, limit int, ch chan<- TradesResponse)
+		GetBalances(ctx context.Context, ch chan<- BalanceResponse)
+		// PlaceOrder sends the order as is, callers validate it once with CheckOrder or ValidateOrder
+		PlaceOrder(ctx context.Context, pair string, side string, rate decimal.Decimal, amount decimal.Decimal, ch chan<- PlaceOrderResponse)
+		CancelOrder(ctx context.Context, orderId string, ch chan<- CancelOrderResponse)
+		OpenOrders(ctx context.Context, pair string, ch chan<- OrdersResponse)
+		OrderInfo(ctx context.Context, orderId string, ch chan<- OrderInfoResponse)
+		// TradeHistory returns fills of the pair, the whole account history when pair is empty
+		// or ErrHistoryPairRequired when the exchange can't list it
+		TradeHistory(ctx context.Context, pair string, ch chan<- TradeHistoryResponse)
 		Release()
 	}
 
+	// ProviderError describes failed call of an exchange or a blockchain explorer.
+	ProviderError struct {
+		Provider string
+		Op       string
+		Err      error
+	}
+
 	Balance struct {
 		Exchange       Exchange
-		Funds          map[string]float64
-		AvailableFunds map[string]float64
+		Funds          map[string]decimal.Decimal
+		AvailableFunds map[string]decimal.Decimal
+		// Address and Label are set on a single cold wallet address breakdown,
+		// empty Address means the exchange or cold wallet summary
+		Address string
+		Label   string
 	}
 
 	Balances []Balance
@@ -50,29 +76,247 @@ type (
 		SName string
 		Link  string
 		Cold  bool
+		// PollInterval is the minimal interval of repeated calls allowed by the exchange rate limit
+		PollInterval time.Duration
 	}
 
 	ByExchangeName struct{ Balances }
 
+	// Ticker is the 24h statistic of the pair. Avg is the 24h average price reported by Yobit,
+	// PrevDay is the price 24h ago reported by Bittrex, zero when the exchange doesn't report it.
 	Ticker struct {
-		High    float64
-		Low     float64
-		Avg     float64
-		Vol     float64
-		VolCur  float64
-		Buy     float64
-		Sell    float64
-		Last    float64
+		High    decimal.Decimal
+		Low     decimal.Decimal
+		Avg     decimal.Decimal
+		PrevDay decimal.Decimal
+		Vol     decimal.Decimal
+		VolCur  decimal.Decimal
+		Buy     decimal.Decimal
+		Sell    decimal.Decimal
+		Last    decimal.Decimal
 		Updated int64
 	}
+
+	// Market is a listed pair of the exchange. Symbol is the exchange native market name,
+	// Precision is the number of price decimal places, Fee is the taker fee in percents.
+	Market struct {
+		Pair      Pair
+		Symbol    string
+		Hidden    bool
+		Precision int32
+		MinAmount decimal.Decimal
+		MinPrice  decimal.Decimal
+		MaxPrice  decimal.Decimal
+		Fee       decimal.Decimal
+	}
+
+	OrderBookLevel struct {
+		Price    decimal.Decimal
+		Quantity decimal.Decimal
+	}
+
+	// OrderBook keeps asks in ascending and bids in descending price order, best level first.
+	OrderBook struct {
+		Pair string
+		Asks []OrderBookLevel
+		Bids []OrderBookLevel
+	}
+
+	// Trade is a public market trade, Side is the taker side.
+	Trade struct {
+		Id        string
+		Pair      string
+		Side      string
+		Price     decimal.Decimal
+		Amount    decimal.Decimal
+		Timestamp int64
+	}
+
+	OrderStatus int
+
+	// Order is an exchange order in canonical form. Pair is always in the lowercase
+	// base_quote form (eth_btc), Side is SideBuy or SideSell.
+	Order struct {
+		Id          string
+		Pair        string
+		Side        string
+		Rate        decimal.Decimal
+		StartAmount decimal.Decimal
+		Amount      decimal.Decimal
+		Created     int64
+		Status      OrderStatus
+	}
+
+	OrderResult struct {
+		OrderId  string
+		Received decimal.Decimal
+		Remains  decimal.Decimal
+	}
+
+	CancelResult struct {
+		OrderId string
+	}
+
+	// Responses carry either a result or an error of the asynchronous call.
+
+	MarketsResponse struct {
+		Markets []Market
+		Err     error
+	}
+
+	OrderBookResponse struct {
+		OrderBook OrderBook
+		Err       error
+	}
+
+	TradesResponse struct {
+		Trades []Trade
+		Err    error
+	}
+
+	TickersResponse struct {
+		Tickers map[string]Ticker
+		Err     error
+	}
+
+	BalanceResponse struct {
+		Balance Balance
+		Err     error
+	}
+
+	PlaceOrderResponse struct {
+		Result OrderResult
+		Err    error
+	}
+
+	CancelOrderResponse struct {
+		Result CancelResult
+		Err    error
+	}
+
+	OrdersResponse struct {
+		Orders []Order
+		Err    error
+	}
+
+	OrderInfoResponse struct {
+		Order Order
+		Err   error
+	}
+
+	TradeHistoryResponse struct {
+		Fills []Fill
+		Err   error
+	}
+
+	// Fill is an executed trade of the account. Fee is the paid commission in quote currency.
+	Fill struct {
+		Id        string
+		OrderId   string
+		Pair      string
+		Side      string
+		Rate      decimal.Decimal
+		Amount    decimal.Decimal
+		Fee       decimal.Decimal
+		Timestamp int64
+	}
+)
+
+const (
+	SideBuy  = "buy"
+	SideSell = "sell"
+)
+
+const (
+	OrderActive OrderStatus = iota
+	OrderFilled
+	OrderCancelled
+	OrderPartiallyCancelled
 )
 
+func (s OrderStatus) String() string {
+	switch s {
+	case OrderActive:
+		return "active"
+	case OrderFilled:
+		return "filled"
+	case OrderCancelled:
+		return "cancelled"
+	case OrderPartiallyCancelled:
+		return "partially cancelled"
+	default:
+		return "unknown"
+	}
+}
+
 func (s Balances) Len() int      { return len(s) }
 func (s Balances) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
 
-func (s ByExchangeName) Less(i, j int) bool { return s.Balances[i].Exchange.Name < s.Balances[j].Exchange.Name }
+// Less keeps address breakdown right after the summary of its cold wallet
+func (s ByExchangeName) Less(i, j int) bool {
+	if s.Balances[i].Exchange.Name != s.Balances[j].Exchange.Name {
+		return s.Balances[i].Exchange.Name < s.Balances[j].Exchange.Name
+	}
+	return s.Balances[i].Address < s.Balances[j].Address
+}
+
+// decimalFunds converts funds of the client libraries working with float64.
+func decimalFunds(funds map[string]float64) map[string]decimal.Decimal {
+	rs := make(map[string]decimal.Decimal, len(funds))
+	for coin, amount := range funds {
+		rs[coin] = decimal.NewFromFloat(amount)
+	}
+	return rs
+}
+
+func (e *ProviderError) Error() string {
+	return fmt.Sprintf("%s.%s: %v", e.Provider, e.Op, e.Err)
+}
+
+func newProviderError(provider string, op string, err error) *ProviderError {
+	return &ProviderError{Provider: provider, Op: op, Err: err}
+}
+
+// ErrOrderOutcomeUnknown is the error of the order request sent to the exchange without a response,
+// the order may be placed
+var ErrOrderOutcomeUnknown = errors.New("no response to the sent order, it may be placed: check open orders")
+
+// IsOrderOutcomeUnknown reports whether PlaceOrder failed after the order could reach the exchange
+func IsOrderOutcomeUnknown(err error) bool {
+	pe, ok := err.(*ProviderError)
+	return ok && pe.Err == ErrOrderOutcomeUnknown
+}
+
+// ErrHistoryPairRequired is the error of TradeHistory with empty pair on exchange that lists the history per pair only
+var ErrHistoryPairRequired = errors.New("whole trade history is not available, pairs are required")
+
+// IsHistoryPairRequired reports whether TradeHistory failed because the exchange needs the pair
+func IsHistoryPairRequired(err error) bool {
+	pe, ok := err.(*ProviderError)
+	return ok && pe.Err == ErrHistoryPairRequired
+}
+
+// awaitCall runs blocking call of a client library without context support and waits
+// for it or for ctx cancellation. Values assigned by the call must not be read when error is returned.
+func awaitCall(ctx context.Context, call func() error) error {
+	done := make(chan error, 1)
+	go func() {
+		done <- call()
+	}()
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// contextTransport binds every request of the client library to ctx of the call.
+type contextTransport struct {
+	ctx      context.Context
+	upstream http.RoundTripper
+}
 
-func fatal(v ...interface{}) {
-	fmt.Printf("%s\n", fmt.Sprint(v))
-	os.Exit(1)
-}
\ No newline at end of file
+func (t *contextTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	return t.upstream.RoundTrip(req.WithContext(t.ctx))
+}
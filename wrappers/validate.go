@@ -0,0 +1,110 @@
+/*
+ * MIT License
+ *
+ * Copyright (c) 2018 Igor Konovalov
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+package wrappers
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"github.com/shopspring/decimal"
+)
+
+// OrderRejectedError is the order breaking market rules of the exchange. It is returned
+// before any trade call is made.
+type OrderRejectedError struct {
+	Exchange string
+	Pair     string
+	Side     string
+	Reason   string
+}
+
+func (e *OrderRejectedError) Error() string {
+	return fmt.Sprintf("%s %s %s order rejected: %s", e.Exchange, e.Side, strings.ToUpper(e.Pair), e.Reason)
+}
+
+// ValidateOrder checks the limit order against the market rules and available funds.
+// Buying requires the total with the taker fee, selling requires the amount of the base currency.
+// Funds are not checked when available is nil.
+func ValidateOrder(exchange string, market Market, available map[string]decimal.Decimal, side string, rate decimal.Decimal, amount decimal.Decimal) error {
+	reject := func(format string, args ...interface{}) error {
+		return &OrderRejectedError{Exchange: exchange, Pair: market.Pair.String(), Side: side, Reason: fmt.Sprintf(format, args...)}
+	}
+	switch {
+	case side != SideBuy && side != SideSell:
+		return reject("unknown side, use %s or %s", SideBuy, SideSell)
+	case market.Hidden:
+		return reject("market is hidden or inactive")
+	case rate.Sign() <= 0:
+		return reject("rate %s is not positive", rate)
+	case amount.Sign() <= 0:
+		return reject("amount %s is not positive", amount)
+	case market.MinAmount.Sign() > 0 && amount.LessThan(market.MinAmount):
+		return reject("amount %s is below the minimum %s %s", amount, market.MinAmount, market.Pair.Base)
+	case market.MinPrice.Sign() > 0 && rate.LessThan(market.MinPrice):
+		return reject("rate %s is below the minimum price %s", rate, market.MinPrice)
+	case market.MaxPrice.Sign() > 0 && rate.GreaterThan(market.MaxPrice):
+		return reject("rate %s is above the maximum price %s", rate, market.MaxPrice)
+	}
+	if available == nil {
+		return nil
+	}
+	if side == SideBuy {
+		total := rate.Mul(amount)
+		required := total.Add(total.Mul(market.Fee).Div(decimal.New(100, 0)))
+		if funds := available[market.Pair.Quote]; funds.LessThan(required) {
+			return reject("%s %s with the fee is required, %s available", required, market.Pair.Quote, funds)
+		}
+	} else if funds := available[market.Pair.Base]; funds.LessThan(amount) {
+		return reject("%s %s is required, %s available", amount, market.Pair.Base, funds)
+	}
+	return nil
+}
+
+// CheckOrder fetches markets and balances of the exchange and validates the order, the market
+// of the pair is returned.
+func CheckOrder(ctx context.Context, exchange CryptCurrencyExchange, name string, pair string, side string, rate decimal.Decimal, amount decimal.Decimal) (Market, error) {
+	marketsChannel := make(chan MarketsResponse, 1)
+	balanceChannel := make(chan BalanceResponse, 1)
+	go exchange.Markets(ctx, marketsChannel)
+	go exchange.GetBalances(ctx, balanceChannel)
+	markets, balance := <-marketsChannel, <-balanceChannel
+	if markets.Err != nil {
+		return Market{}, markets.Err
+	}
+	canonical, err := ParsePair(pair)
+	if err != nil {
+		return Market{}, &OrderRejectedError{Exchange: name, Pair: pair, Side: side, Reason: err.Error()}
+	}
+	for _, m := range markets.Markets {
+		if m.Pair != canonical {
+			continue
+		}
+		if balance.Err != nil {
+			return m, balance.Err
+		}
+		return m, ValidateOrder(name, m, balance.Balance.AvailableFunds, side, rate, amount)
+	}
+	return Market{}, &OrderRejectedError{Exchange: name, Pair: pair, Side: side, Reason: "market is not listed"}
+}
@@ -25,7 +25,24 @@
 package wrappers
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"github.com/ikonovalov/go-yobit"
+	"github.com/shopspring/decimal"
+	"strconv"
+	"time"
+)
+
+const (
+	yobitName = "Yobit"
+	// yobitTickersBatch is the max number of pairs of the single Tickers24 request
+	yobitTickersBatch = 50
+	// YobitPollInterval keeps repeated polls within the Yobit limit of 100 requests per minute
+	YobitPollInterval = 2 * time.Second
+	// yobitResponseGrace is the wait for the response of the sent trade or cancel request after ctx
+	// is done, go-yobit requests can't be cancelled and they may be executed anyway
+	yobitResponseGrace = 30 * time.Second
 )
 
 type YobitWrapper struct {
@@ -53,40 +70,359 @@ func (yw *YobitWrapper) Release() {
 	yw.yobit.Release()
 }
 
-func (yw *YobitWrapper) GetBalances(ch chan<- Balance) {
-	channelYobit := make(chan yobit.GetInfoResponse)
+// yobitError converts error message of the Yobit private API response
+func yobitError(op string, message string) error {
+	if message == "" {
+		return nil
+	}
+	return newProviderError(yobitName, op, errors.New(message))
+}
+
+func (yw *YobitWrapper) GetBalances(ctx context.Context, ch chan<- BalanceResponse) {
+	channelYobit := make(chan yobit.GetInfoResponse, 1)
 	go yw.yobit.GetInfo(channelYobit)
-	yobitGetInfoRes := <-channelYobit
+	var yobitGetInfoRes yobit.GetInfoResponse
+	select {
+	case yobitGetInfoRes = <-channelYobit:
+	case <-ctx.Done():
+		ch <- BalanceResponse{Err: newProviderError(yobitName, "GetInfo", ctx.Err())}
+		return
+	}
+	if err := yobitError("GetInfo", yobitGetInfoRes.Error); err != nil {
+		ch <- BalanceResponse{Err: err}
+		return
+	}
 	data := yobitGetInfoRes.Data
 
 	yobitBalances := Balance{
-		Exchange:       Exchange{Name: "Yobit", Link: yobit.Url},
-		Funds:          data.FundsIncludeOrders,
-		AvailableFunds: data.Funds,
+		Exchange:       Exchange{Name: yobitName, Link: yobit.Url},
+		Funds:          yobitSymbols.funds(decimalFunds(data.FundsIncludeOrders)),
+		AvailableFunds: yobitSymbols.funds(decimalFunds(data.Funds)),
 	}
-	ch <- yobitBalances
+	ch <- BalanceResponse{Balance: yobitBalances}
 }
 
-func (yw *YobitWrapper) GetTickers(pairs []string, ch chan <- map[string]Ticker) {
-	tickersChan := make(chan yobit.TickerInfoResponse)
-	go yw.yobit.Tickers24(pairs, tickersChan)
-	tickerRs := <-tickersChan
+func (yw *YobitWrapper) Markets(ctx context.Context, ch chan<- MarketsResponse) {
+	channel := make(chan yobit.InfoResponse, 1)
+	go yw.yobit.Info(channel)
+	var info yobit.InfoResponse
+	select {
+	case info = <-channel:
+	case <-ctx.Done():
+		ch <- MarketsResponse{Err: newProviderError(yobitName, "Info", ctx.Err())}
+		return
+	}
+	rs := make([]Market, 0, len(info.Pairs))
+	for symbol, desc := range info.Pairs {
+		pair, err := yobitSymbols.Canonical(symbol)
+		if err != nil {
+			continue
+		}
+		rs = append(rs, Market{
+			Pair:      pair,
+			Symbol:    symbol,
+			Hidden:    desc.Hidden == 1,
+			Precision: int32(desc.DecimalPlaces),
+			MinAmount: decimal.NewFromFloat(desc.MinAmount),
+			MinPrice:  decimal.NewFromFloat(desc.MinPrice),
+			MaxPrice:  decimal.NewFromFloat(desc.MaxPrice),
+			Fee:       decimal.NewFromFloat(desc.Fee),
+		})
+	}
+	ch <- MarketsResponse{Markets: rs}
+}
 
-	// convert
+func (yw *YobitWrapper) OrderBook(ctx context.Context, pair string, limit int, ch chan<- OrderBookResponse) {
+	symbol, err := yobitSymbols.nativePair(pair)
+	if err != nil {
+		ch <- OrderBookResponse{Err: newProviderError(yobitName, "Depth", err)}
+		return
+	}
+	channel := make(chan yobit.DepthResponse, 1)
+	go yw.yobit.DepthLimited(symbol, limit, channel)
+	var depth yobit.DepthResponse
+	select {
+	case depth = <-channel:
+	case <-ctx.Done():
+		ch <- OrderBookResponse{Err: newProviderError(yobitName, "Depth", ctx.Err())}
+		return
+	}
+	offers, ok := depth.Offers[symbol]
+	if !ok {
+		ch <- OrderBookResponse{Err: newProviderError(yobitName, "Depth", fmt.Errorf("no order book of %s", pair))}
+		return
+	}
+	levels := func(offers []yobit.Offer) []OrderBookLevel {
+		rs := make([]OrderBookLevel, 0, len(offers))
+		for _, o := range offers {
+			rs = append(rs, OrderBookLevel{Price: decimal.NewFromFloat(o.Price), Quantity: decimal.NewFromFloat(o.Quantity)})
+		}
+		return rs
+	}
+	ch <- OrderBookResponse{OrderBook: OrderBook{Pair: pair, Asks: levels(offers.Asks), Bids: levels(offers.Bids)}}
+}
+
+func (yw *YobitWrapper) Trades(ctx context.Context, pair string, limit int, ch chan<- TradesResponse) {
+	symbol, err := yobitSymbols.nativePair(pair)
+	if err != nil {
+		ch <- TradesResponse{Err: newProviderError(yobitName, "Trades", err)}
+		return
+	}
+	channel := make(chan yobit.TradesResponse, 1)
+	go yw.yobit.TradesLimited(symbol, limit, channel)
+	var trades yobit.TradesResponse
+	select {
+	case trades = <-channel:
+	case <-ctx.Done():
+		ch <- TradesResponse{Err: newProviderError(yobitName, "Trades", ctx.Err())}
+		return
+	}
+	pairTrades, ok := trades.Trades[symbol]
+	if !ok {
+		ch <- TradesResponse{Err: newProviderError(yobitName, "Trades", fmt.Errorf("no trades of %s", pair))}
+		return
+	}
+	rs := make([]Trade, 0, len(pairTrades))
+	for _, t := range pairTrades {
+		// ask is a sale to the bid, bid is a purchase from the ask
+		side := SideBuy
+		if t.Type == "ask" {
+			side = SideSell
+		}
+		rs = append(rs, Trade{
+			Id:        strconv.FormatUint(t.Tid, 10),
+			Pair:      pair,
+			Side:      side,
+			Price:     decimal.NewFromFloat(t.Price),
+			Amount:    decimal.NewFromFloat(t.Amount),
+			Timestamp: t.Timestamp,
+		})
+	}
+	ch <- TradesResponse{Trades: rs}
+}
+
+func (yw *YobitWrapper) GetTickers(ctx context.Context, pairs []string, ch chan <- TickersResponse) {
+	symbols := make([]string, 0, len(pairs))
+	for _, pair := range pairs {
+		symbol, err := yobitSymbols.nativePair(pair)
+		if err != nil {
+			ch <- TickersResponse{Err: newProviderError(yobitName, "Tickers24", err)}
+			return
+		}
+		symbols = append(symbols, symbol)
+	}
+	// Yobit limits the number of pairs of the single request
 	rs := make(map[string]Ticker)
-	for k,yt := range tickerRs.Tickers {
-		rs[k] = Ticker {
-			High: yt.High,
-			Low: yt.Low,
-			Avg: yt.Avg,
-			Vol: yt.Vol,
-			VolCur: yt.VolCur,
-			Buy: yt.Buy,
-			Sell: yt.Sell,
-			Last: yt.Last,
-			Updated: yt.Updated,
+	for start := 0; start < len(symbols); start += yobitTickersBatch {
+		end := start + yobitTickersBatch
+		if end > len(symbols) {
+			end = len(symbols)
+		}
+		tickersChan := make(chan yobit.TickerInfoResponse, 1)
+		go yw.yobit.Tickers24(symbols[start:end], tickersChan)
+		var tickerRs yobit.TickerInfoResponse
+		select {
+		case tickerRs = <-tickersChan:
+		case <-ctx.Done():
+			ch <- TickersResponse{Err: newProviderError(yobitName, "Tickers24", ctx.Err())}
+			return
+		}
+
+		// convert
+		for k,yt := range tickerRs.Tickers {
+			rs[yobitSymbols.canonicalPair(k)] = Ticker {
+				High: decimal.NewFromFloat(yt.High),
+				Low: decimal.NewFromFloat(yt.Low),
+				Avg: decimal.NewFromFloat(yt.Avg),
+				Vol: decimal.NewFromFloat(yt.Vol),
+				VolCur: decimal.NewFromFloat(yt.VolCur),
+				Buy: decimal.NewFromFloat(yt.Buy),
+				Sell: decimal.NewFromFloat(yt.Sell),
+				Last: decimal.NewFromFloat(yt.Last),
+				Updated: yt.Updated,
+			}
+		}
+	}
+	ch <- TickersResponse{Tickers: rs}
+
+}
+
+func (yw *YobitWrapper) PlaceOrder(ctx context.Context, pair string, side string, rate decimal.Decimal, amount decimal.Decimal, ch chan<- PlaceOrderResponse) {
+	// go-yobit takes float64, Yobit accepts at most 8 decimal places anyway.
+	// The amount is truncated, rounding could trade more than requested.
+	rateF64, _ := rate.Round(8).Float64()
+	amountF64, _ := amount.Truncate(8).Float64()
+	symbol, err := yobitSymbols.nativePair(pair)
+	if err != nil {
+		ch <- PlaceOrderResponse{Err: newProviderError(yobitName, "Trade", err)}
+		return
+	}
+	channel := make(chan yobit.TradeResponse, 1)
+	go yw.yobit.Trade(symbol, side, rateF64, amountF64, channel)
+	var response yobit.TradeResponse
+	select {
+	case response = <-channel:
+	case <-ctx.Done():
+		select {
+		case response = <-channel:
+		case <-time.After(yobitResponseGrace):
+			ch <- PlaceOrderResponse{Err: newProviderError(yobitName, "Trade", ErrOrderOutcomeUnknown)}
+			return
 		}
 	}
-	ch <- rs
+	if err := yobitError("Trade", response.Error); err != nil {
+		ch <- PlaceOrderResponse{Err: err}
+		return
+	}
+	trade := response.Result
+	ch <- PlaceOrderResponse{Result: OrderResult{
+		OrderId:  strconv.FormatInt(int64(trade.OrderId), 10),
+		Received: decimal.NewFromFloat(trade.Received),
+		Remains:  decimal.NewFromFloat(trade.Remains),
+	}}
+}
+
+func (yw *YobitWrapper) CancelOrder(ctx context.Context, orderId string, ch chan<- CancelOrderResponse) {
+	channel := make(chan yobit.CancelOrderResponse, 1)
+	go yw.yobit.CancelOrder(orderId, channel)
+	var cancelResult yobit.CancelOrderResponse
+	select {
+	case cancelResult = <-channel:
+	case <-ctx.Done():
+		select {
+		case cancelResult = <-channel:
+		case <-time.After(yobitResponseGrace):
+			ch <- CancelOrderResponse{Err: newProviderError(yobitName, "CancelOrder", ctx.Err())}
+			return
+		}
+	}
+	if err := yobitError("CancelOrder", cancelResult.Error); err != nil {
+		ch <- CancelOrderResponse{Err: err}
+		return
+	}
+	ch <- CancelOrderResponse{Result: CancelResult{OrderId: strconv.FormatInt(int64(cancelResult.Result.OrderId), 10)}}
+}
+
+func (yw *YobitWrapper) OpenOrders(ctx context.Context, pair string, ch chan<- OrdersResponse) {
+	symbol, err := yobitSymbols.nativePair(pair)
+	if err != nil {
+		ch <- OrdersResponse{Err: newProviderError(yobitName, "ActiveOrders", err)}
+		return
+	}
+	channel := make(chan yobit.ActiveOrdersResponse, 1)
+	go yw.yobit.ActiveOrders(symbol, channel)
+	var activeOrders yobit.ActiveOrdersResponse
+	select {
+	case activeOrders = <-channel:
+	case <-ctx.Done():
+		ch <- OrdersResponse{Err: newProviderError(yobitName, "ActiveOrders", ctx.Err())}
+		return
+	}
+	if err := yobitError("ActiveOrders", activeOrders.Error); err != nil {
+		ch <- OrdersResponse{Err: err}
+		return
+	}
+
+	rs := make([]Order, 0, len(activeOrders.Orders))
+	for id, ord := range activeOrders.Orders {
+		created, _ := strconv.ParseInt(ord.Created, 10, 64)
+		rs = append(rs, Order{
+			Id:      id,
+			Pair:    yobitSymbols.canonicalPair(ord.Pair),
+			Side:    ord.Type,
+			Rate:    decimal.NewFromFloat(ord.Rate),
+			Amount:  decimal.NewFromFloat(ord.Amount),
+			Created: created,
+			Status:  OrderStatus(ord.Status),
+		})
+	}
+	ch <- OrdersResponse{Orders: rs}
+}
 
+func (yw *YobitWrapper) OrderInfo(ctx context.Context, orderId string, ch chan<- OrderInfoResponse) {
+	channel := make(chan yobit.OrderInfoResponse, 1)
+	go yw.yobit.OrderInfo(orderId, channel)
+	var orderInfo yobit.OrderInfoResponse
+	select {
+	case orderInfo = <-channel:
+	case <-ctx.Done():
+		ch <- OrderInfoResponse{Err: newProviderError(yobitName, "OrderInfo", ctx.Err())}
+		return
+	}
+	if err := yobitError("OrderInfo", orderInfo.Error); err != nil {
+		ch <- OrderInfoResponse{Err: err}
+		return
+	}
+
+	var rs Order
+	for id, info := range orderInfo.Orders {
+		created, _ := strconv.ParseInt(info.Created, 10, 64)
+		rs = Order{
+			Id:          id,
+			Pair:        yobitSymbols.canonicalPair(info.Pair),
+			Side:        info.Type,
+			Rate:        decimal.NewFromFloat(info.Rate),
+			StartAmount: decimal.NewFromFloat(info.StartAmount),
+			Amount:      decimal.NewFromFloat(info.Amount),
+			Created:     created,
+			Status:      OrderStatus(info.Status),
+		}
+	}
+	ch <- OrderInfoResponse{Order: rs}
+}
+
+// TradeHistory queries Yobit history of the pair, Yobit has no whole history request and listing every
+// market of the held coins would exceed the request limit, so empty pair is ErrHistoryPairRequired.
+// Fees are estimated with the market fee as Yobit history doesn't report them.
+func (yw *YobitWrapper) TradeHistory(ctx context.Context, pair string, ch chan<- TradeHistoryResponse) {
+	if pair == "" {
+		ch <- TradeHistoryResponse{Err: newProviderError(yobitName, "TradeHistory", ErrHistoryPairRequired)}
+		return
+	}
+	symbol, err := yobitSymbols.nativePair(pair)
+	if err != nil {
+		ch <- TradeHistoryResponse{Err: newProviderError(yobitName, "TradeHistory", err)}
+		return
+	}
+	marketsChannel := make(chan MarketsResponse, 1)
+	go yw.Markets(ctx, marketsChannel)
+	channel := make(chan yobit.TradeHistoryResponse, 1)
+	go yw.yobit.TradeHistory(symbol, channel)
+	var history yobit.TradeHistoryResponse
+	select {
+	case history = <-channel:
+	case <-ctx.Done():
+		ch <- TradeHistoryResponse{Err: newProviderError(yobitName, "TradeHistory", ctx.Err())}
+		return
+	}
+	if err := yobitError("TradeHistory", history.Error); err != nil {
+		ch <- TradeHistoryResponse{Err: err}
+		return
+	}
+	markets := <-marketsChannel
+	if markets.Err != nil {
+		ch <- TradeHistoryResponse{Err: markets.Err}
+		return
+	}
+	fees := make(map[string]decimal.Decimal, len(markets.Markets))
+	for _, m := range markets.Markets {
+		fees[m.Pair.String()] = m.Fee
+	}
+
+	rs := make([]Fill, 0, len(history.Orders))
+	for tx, h := range history.Orders {
+		timestamp, _ := strconv.ParseInt(h.Timestamp, 10, 64)
+		fill := Fill{
+			Id:        tx,
+			OrderId:   h.OrderId,
+			Pair:      yobitSymbols.canonicalPair(h.Pair),
+			Side:      h.Type,
+			Rate:      decimal.NewFromFloat(h.Rate),
+			Amount:    decimal.NewFromFloat(h.Amount),
+			Timestamp: timestamp,
+		}
+		fill.Fee = fill.Rate.Mul(fill.Amount).Mul(fees[fill.Pair]).Div(decimal.New(100, 0))
+		rs = append(rs, fill)
+	}
+	ch <- TradeHistoryResponse{Fills: rs}
 }